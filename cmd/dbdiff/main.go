@@ -0,0 +1,70 @@
+// dbdiff compares the model structs of a Go package with the live tables of
+// a MySQL database.
+//
+// Usage:
+//
+//	dbdiff -config mysql.yaml -dir ./model [-alter]
+//
+// Every struct with a db tag is a model. Its table is the value of the
+// <Struct>Table constant dbgen writes, else the snake_case struct name.
+// Fields are read as db.Model documents, schema tags included. Drifts are
+// printed one per line, or the ALTER statements with -alter; the exit
+// status is 1 when there are drifts.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/MangoMilk/go-lib/db"
+	"github.com/MangoMilk/go-lib/dwarfloader"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"os"
+)
+
+func main() {
+	configPath := flag.String("config", "mysql.yaml", "mysql config file")
+	dir := flag.String("dir", ".", "directory of the model package")
+	alter := flag.Bool("alter", false, "print the ALTER statements instead of the drifts")
+	flag.Parse()
+
+	// db logs failed statements through dwarflog, the error is printed below as well
+	dwarflog.Setup(&dwarflog.Config{Format: dwarflog.PaleFormat, Path: os.TempDir(), FilePrefix: "dbdiff_"})
+
+	drifts, err := run(*configPath, *dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dbdiff:", err)
+		os.Exit(2)
+	}
+
+	if *alter {
+		for _, statement := range db.Alters(drifts) {
+			fmt.Println(statement + ";")
+		}
+	} else {
+		for _, d := range drifts {
+			fmt.Println(d)
+		}
+	}
+
+	if len(drifts) > 0 {
+		os.Exit(1)
+	}
+}
+
+func run(configPath string, dir string) ([]db.Drift, error) {
+	var config db.MysqlConfig
+	if err := dwarfloader.Load(configPath, &config); err != nil {
+		return nil, err
+	}
+
+	models, err := parseModels(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mysql := db.NewMysql(config)
+	mysql.Open()
+	defer mysql.Close()
+
+	return mysql.Diff(config.Database, models...)
+}
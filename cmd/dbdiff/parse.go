@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/MangoMilk/go-lib/db"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// parseModels reads the models of the package in dir, sorted by table.
+func parseModels(dir string) ([]db.Model, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var models []db.Model
+	for _, pkg := range pkgs {
+		consts := make(map[string]string)
+		structs := make(map[string]*ast.StructType)
+
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok {
+					continue
+				}
+
+				for _, spec := range gen.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if st, ok := s.Type.(*ast.StructType); ok {
+							structs[s.Name.Name] = st
+						}
+					case *ast.ValueSpec:
+						for i, name := range s.Names {
+							if i >= len(s.Values) {
+								break
+							}
+							if lit, ok := s.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+								consts[name.Name], _ = strconv.Unquote(lit.Value)
+							}
+						}
+					}
+				}
+			}
+		}
+
+		for name, st := range structs {
+			if !hasDBTag(st) {
+				continue
+			}
+
+			table, ok := consts[name+"Table"]
+			if !ok {
+				table = snake(name)
+			}
+
+			model := db.Model{Table: table}
+			for _, field := range st.Fields.List {
+				var tag reflect.StructTag
+				if field.Tag != nil {
+					value, _ := strconv.Unquote(field.Tag.Value)
+					tag = reflect.StructTag(value)
+				}
+
+				for _, fieldName := range field.Names {
+					if fieldName.IsExported() {
+						model.AddField(fieldName.Name, types.ExprString(field.Type), tag)
+					}
+				}
+			}
+			models = append(models, model)
+		}
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Table < models[j].Table
+	})
+
+	return models, nil
+}
+
+func hasDBTag(st *ast.StructType) bool {
+	for _, field := range st.Fields.List {
+		if field.Tag == nil {
+			continue
+		}
+		value, _ := strconv.Unquote(field.Tag.Value)
+		if _, ok := reflect.StructTag(value).Lookup("db"); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// snake turns CamelCase into snake_case, keeping acronyms together: UserID is user_id.
+func snake(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
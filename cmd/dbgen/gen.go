@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"github.com/MangoMilk/go-lib/db"
+	"go/format"
+	"strings"
+)
+
+func generate(pkg string, table db.Table) ([]byte, error) {
+	if _, err := declared(table); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	var name string = camel(table.Name)
+
+	fmt.Fprintf(&b, "// Code generated by dbgen. DO NOT EDIT.\n\npackage %s\n\n", pkg)
+
+	imports := make(map[string]bool)
+	for _, column := range table.Columns {
+		if t := goType(column); strings.HasPrefix(t, "sql.") {
+			imports["database/sql"] = true
+		}
+	}
+	for path := range imports {
+		fmt.Fprintf(&b, "import %q\n\n", path)
+	}
+
+	fmt.Fprintf(&b, "const %sTable = %q\n\n", name, table.Name)
+
+	fmt.Fprintf(&b, "type %sColumn string\n\nconst (\n", name)
+	for _, column := range table.Columns {
+		fmt.Fprintf(&b, "\t%s%s %sColumn = %q\n", name, camel(column.Name), name, column.Name)
+	}
+	b.WriteString(")\n\n")
+
+	if table.Comment != "" {
+		fmt.Fprintf(&b, "// %s %s\n", name, oneLine(table.Comment))
+	}
+	fmt.Fprintf(&b, "type %s struct {\n", name)
+	for _, column := range table.Columns {
+		fmt.Fprintf(&b, "\t%s %s `db:%q json:%q`", camel(column.Name), goType(column), column.Name, column.Name)
+		if column.Comment != "" {
+			fmt.Fprintf(&b, " // %s", oneLine(column.Comment))
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n")
+
+	return format.Source([]byte(b.String()))
+}
+
+/*
+ * declared returns the package level names generated for table, by what
+ * they are. It fails when two of them, or two fields, would be the same:
+ * the source would not compile.
+ */
+func declared(table db.Table) (map[string]string, error) {
+	var name string = camel(table.Name)
+	names := map[string]string{
+		name:            "struct of table " + table.Name,
+		name + "Table":  "name constant of table " + table.Name,
+		name + "Column": "column type of table " + table.Name,
+	}
+
+	fields := make(map[string]string, len(table.Columns))
+	for _, column := range table.Columns {
+		field := camel(column.Name)
+		if other, ok := fields[field]; ok {
+			return nil, fmt.Errorf("columns %s and %s are both field %s", other, column.Name, field)
+		}
+		fields[field] = column.Name
+
+		if other, ok := names[name+field]; ok {
+			return nil, fmt.Errorf("constant %s of column %s clashes with the %s", name+field, column.Name, other)
+		}
+		names[name+field] = "constant of column " + table.Name + "." + column.Name
+	}
+
+	return names, nil
+}
+
+// checkNames fails when tables generated into one package declare the same name.
+func checkNames(tables []db.Table) error {
+	seen := make(map[string]string)
+	for _, table := range tables {
+		names, err := declared(table)
+		if err != nil {
+			return fmt.Errorf("%s: %v", table.Name, err)
+		}
+
+		for name, what := range names {
+			if other, ok := seen[name]; ok {
+				return fmt.Errorf("%s is both the %s and the %s", name, other, what)
+			}
+			seen[name] = what
+		}
+	}
+
+	return nil
+}
+
+// goType maps a column to the type it scans into with the default DSN of
+// db.NewMysql, which does not set parseTime, so temporal columns are strings.
+func goType(column db.Column) string {
+	var unsigned bool = strings.Contains(column.ColumnType, "unsigned")
+	var nullable bool = column.Nullable()
+
+	switch column.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year":
+		if nullable && unsigned && column.DataType == "bigint" {
+			// the top bit does not fit sql.NullInt64
+			return "*uint64"
+		}
+		if nullable {
+			return "sql.NullInt64"
+		}
+		if unsigned {
+			return "uint64"
+		}
+		return "int64"
+	case "float", "double", "real":
+		if nullable {
+			return "sql.NullFloat64"
+		}
+		return "float64"
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob", "bit", "geometry":
+		return "[]byte"
+	}
+
+	// char, text, enum, set, json, decimal (keeps precision), date and time types
+	if nullable {
+		return "sql.NullString"
+	}
+	return "string"
+}
+
+// camel turns snake_case into CamelCase.
+func camel(s string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == '_' || r == '-' || r == ' '
+	}) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+
+	name := b.String()
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "T" + name
+	}
+	return name
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/MangoMilk/go-lib/db"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGoType(t *testing.T) {
+	cases := []struct {
+		dataType   string
+		columnType string
+		nullable   string
+		want       string
+	}{
+		{"int", "int(11)", "NO", "int64"},
+		{"int", "int(10) unsigned", "NO", "uint64"},
+		{"int", "int(10) unsigned", "YES", "sql.NullInt64"},
+		{"bigint", "bigint", "YES", "sql.NullInt64"},
+		{"bigint", "bigint unsigned", "NO", "uint64"},
+		{"bigint", "bigint unsigned", "YES", "*uint64"},
+		{"tinyint", "tinyint(1)", "NO", "int64"},
+		{"double", "double", "YES", "sql.NullFloat64"},
+		{"decimal", "decimal(10,2)", "NO", "string"},
+		{"varchar", "varchar(64)", "YES", "sql.NullString"},
+		{"datetime", "datetime", "NO", "string"},
+		{"blob", "blob", "YES", "[]byte"},
+	}
+
+	fake := db.NewFake()
+	mysql := fake.Mysql()
+
+	var columns [][]interface{}
+	model := db.Model{Table: "t"}
+	for i, c := range cases {
+		name := "c" + string(rune('a'+i))
+		column := db.Column{Name: name, DataType: c.dataType, ColumnType: c.columnType, IsNullable: c.nullable}
+		if got := goType(column); got != c.want {
+			t.Errorf("%s %s: %s, want %s", c.columnType, c.nullable, got, c.want)
+		}
+
+		columns = append(columns, []interface{}{"t", name, int64(i + 1), nil, c.nullable, c.dataType, c.columnType, "", "", ""})
+		model.AddField(camel(name), goType(column), reflect.StructTag(`db:"`+name+`"`))
+	}
+
+	// the generated types are the ones Diff accepts
+	fake.On("information_schema.TABLES").ReturnRows([]string{"table_name", "table_comment"}, []interface{}{"t", ""})
+	fake.On("information_schema.COLUMNS").ReturnRows(
+		[]string{"table_name", "column_name", "ordinal_position", "column_default", "is_nullable", "data_type", "column_type", "column_key", "extra", "column_comment"},
+		columns...,
+	)
+	drifts, err := mysql.Diff("shop", model)
+	if err != nil || len(drifts) != 0 {
+		t.Fatal(drifts, err)
+	}
+}
+
+func TestCamel(t *testing.T) {
+	for in, want := range map[string]string{
+		"user":        "User",
+		"user_order":  "UserOrder",
+		"order-item":  "OrderItem",
+		"created at":  "CreatedAt",
+		"2fa_secret":  "T2faSecret",
+		"__id":        "Id",
+		"":            "T",
+		"already_OK_": "AlreadyOK",
+	} {
+		if got := camel(in); got != want {
+			t.Errorf("camel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	src, err := generate("model", db.Table{
+		Name:    "user_order",
+		Comment: "orders\n  of users",
+		Columns: []db.Column{
+			{Name: "id", DataType: "bigint", ColumnType: "bigint unsigned", IsNullable: "NO"},
+			{Name: "note", DataType: "varchar", ColumnType: "varchar(64)", IsNullable: "YES", Comment: "free text"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := string(src)
+	for _, want := range []string{
+		"// Code generated by dbgen. DO NOT EDIT.",
+		"package model",
+		`import "database/sql"`,
+		`const UserOrderTable = "user_order"`,
+		`UserOrderNote UserOrderColumn = "note"`,
+		"// UserOrder orders of users",
+		"Id   uint64         `db:\"id\" json:\"id\"`",
+		"Note sql.NullString `db:\"note\" json:\"note\"` // free text",
+	} {
+		if !strings.Contains(code, want) {
+			t.Fatalf("missing %q in\n%s", want, code)
+		}
+	}
+}
+
+func TestGenerateClash(t *testing.T) {
+	for _, columns := range [][]string{
+		{"id", "table"},
+		{"id", "column"},
+		{"a_b", "aB"},
+	} {
+		table := db.Table{Name: "user"}
+		for _, name := range columns {
+			table.Columns = append(table.Columns, db.Column{Name: name, DataType: "int", ColumnType: "int", IsNullable: "NO"})
+		}
+		if _, err := generate("model", table); err == nil {
+			t.Fatal(columns)
+		}
+	}
+
+	// UserColumn is the column type of user and the struct of user_column
+	tables := []db.Table{
+		{Name: "user", Columns: []db.Column{{Name: "id"}}},
+		{Name: "user_column", Columns: []db.Column{{Name: "id"}}},
+	}
+	if err := checkNames(tables); err == nil || !strings.Contains(err.Error(), "UserColumn") {
+		t.Fatal(err)
+	}
+	if err := checkNames(tables[:1]); err != nil {
+		t.Fatal(err)
+	}
+}
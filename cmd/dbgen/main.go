@@ -0,0 +1,92 @@
+// dbgen generates Go model structs from the tables of a MySQL database.
+//
+// Usage:
+//
+//	dbgen -config mysql.yaml -out ./model -package model [-tables user,order]
+//
+// The config file holds a db.MysqlConfig in any format dwarfloader.Load
+// supports. One file is written per table, with a struct carrying db and
+// json tags, the table name and typed column name constants. Nothing is
+// written when two generated names would clash.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/MangoMilk/go-lib/db"
+	"github.com/MangoMilk/go-lib/dwarfloader"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	configPath := flag.String("config", "mysql.yaml", "mysql config file")
+	out := flag.String("out", ".", "output directory")
+	pkg := flag.String("package", "model", "package name of the generated files")
+	only := flag.String("tables", "", "comma separated tables, all tables if empty")
+	flag.Parse()
+
+	// db logs failed statements through dwarflog, the error is printed below as well
+	dwarflog.Setup(&dwarflog.Config{Format: dwarflog.PaleFormat, Path: os.TempDir(), FilePrefix: "dbgen_"})
+
+	if err := run(*configPath, *out, *pkg, *only); err != nil {
+		fmt.Fprintln(os.Stderr, "dbgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath string, out string, pkg string, only string) error {
+	var config db.MysqlConfig
+	if err := dwarfloader.Load(configPath, &config); err != nil {
+		return err
+	}
+
+	mysql := db.NewMysql(config)
+	mysql.Open()
+	defer mysql.Close()
+
+	tables, err := mysql.Tables(config.Database)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(only, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
+	}
+
+	var selected []db.Table
+	for _, table := range tables {
+		if len(wanted) == 0 || wanted[table.Name] {
+			selected = append(selected, table)
+		}
+	}
+	// before writing anything, a clash would leave the package broken
+	if err := checkNames(selected); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+
+	for _, table := range selected {
+		src, err := generate(pkg, table)
+		if err != nil {
+			return fmt.Errorf("%s: %v", table.Name, err)
+		}
+
+		file := filepath.Join(out, table.Name+".go")
+		if err := ioutil.WriteFile(file, src, 0644); err != nil {
+			return err
+		}
+		fmt.Println(file)
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"math"
+	"sync"
+	"time"
+)
+
+const advisoryCheckInterval = time.Second * 3
+
+var (
+	ErrLockTimeout  = errors.New("advisory lock timeout")
+	ErrLockReleased = errors.New("advisory lock already released")
+)
+
+/*
+ * AdvisoryLock
+ *
+ * Cross-instance mutex on MySQL GET_LOCK. The lock belongs to the session that
+ * took it, so it keeps a dedicated connection out of the pool until Unlock.
+ * A background check closes Lost() when that connection drops or the server
+ * no longer sees this session as the owner; the holder must stop working on
+ * the protected resource then. The lock also pins the pool it came from: a
+ * Reload waits for Unlock up to ReloadDrainTimeout, then closes the old pool
+ * and the lock is lost with it, so hold locks for short work only.
+ */
+type AdvisoryLock struct {
+	name    string
+	conn    *sql.Conn
+	release func() // unpins the pool of conn
+	lost    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (db *Mysql) Lock(ctx context.Context, name string, timeout time.Duration) (*AdvisoryLock, error) {
+	p, release := db.acquire()
+
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		release()
+		return nil, Classify(err)
+	}
+
+	var acquired sql.NullInt64
+	var sqlStr string = "SELECT GET_LOCK(?, ?)"
+	var seconds int64 = int64(math.Ceil(timeout.Seconds()))
+
+	if err := conn.QueryRowContext(ctx, sqlStr, name, seconds).Scan(&acquired); err != nil {
+		dwarflog.Error(err, sqlStr, name)
+		conn.Close()
+		release()
+		return nil, Classify(err)
+	}
+
+	if acquired.Int64 != 1 {
+		conn.Close()
+		release()
+		return nil, ErrLockTimeout
+	}
+
+	lock := &AdvisoryLock{
+		name:    name,
+		conn:    conn,
+		release: release,
+		lost:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go lock.watch()
+
+	return lock, nil
+}
+
+func Lock(ctx context.Context, name string, timeout time.Duration) (*AdvisoryLock, error) {
+	return mysql.Lock(ctx, name, timeout)
+}
+
+func (l *AdvisoryLock) Name() string {
+	return l.name
+}
+
+// Lost is closed when the lock can no longer be guaranteed.
+func (l *AdvisoryLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *AdvisoryLock) watch() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(advisoryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if !l.held() {
+				dwarflog.Error(ErrConnLost, "advisory lock lost", l.name)
+				close(l.lost)
+				return
+			}
+		}
+	}
+}
+
+func (l *AdvisoryLock) held() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), advisoryCheckInterval)
+	defer cancel()
+
+	var owned sql.NullInt64
+	err := l.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?) = CONNECTION_ID()", l.name).Scan(&owned)
+
+	return err == nil && owned.Int64 == 1
+}
+
+// Unlock releases the lock and returns its connection to the pool.
+func (l *AdvisoryLock) Unlock() error {
+	err := ErrLockReleased
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+
+		var sqlStr string = "SELECT RELEASE_LOCK(?)"
+		var released sql.NullInt64
+		err = l.conn.QueryRowContext(context.Background(), sqlStr, l.name).Scan(&released)
+		if err != nil {
+			dwarflog.Error(err, sqlStr, l.name)
+			err = Classify(err)
+		}
+
+		if closeErr := l.conn.Close(); err == nil {
+			err = closeErr
+		}
+		l.release()
+	})
+
+	return err
+}
@@ -0,0 +1,311 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/MangoMilk/go-lib/dwarflog"
+)
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (i *TxInstance) queryer() (queryer, error) {
+	if i.Tx == nil {
+		return nil, ErrNoTx
+	}
+	return i.Tx, nil
+}
+
+func count(ctx context.Context, db *Mysql, q queryer, table string, condition map[string]interface{}) (int64, error) {
+	condition, err := db.prepareCondition(ctx, table, condition)
+	if err != nil {
+		return 0, err
+	}
+
+	sqlStr, args := buildSelect("COUNT(*)", table, condition)
+
+	db.explain(ctx, sqlStr, args)
+
+	st, err := db.guard(ctx, table, sqlStr)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err = q.QueryRowContext(st.ctx, st.query, args...).Scan(&n)
+	st.finish(err)
+	if err != nil {
+		dwarflog.Error(err, sqlStr, args)
+		return 0, Classify(err)
+	}
+
+	return n, nil
+}
+
+func exists(ctx context.Context, db *Mysql, q queryer, table string, condition map[string]interface{}) (bool, error) {
+	condition, err := db.prepareCondition(ctx, table, condition)
+	if err != nil {
+		return false, err
+	}
+
+	sqlStr, args := buildSelect("1", table, condition)
+	sqlStr += " LIMIT 1"
+
+	db.explain(ctx, sqlStr, args)
+
+	st, err := db.guard(ctx, table, sqlStr)
+	if err != nil {
+		return false, err
+	}
+
+	var one int
+	err = q.QueryRowContext(st.ctx, st.query, args...).Scan(&one)
+	st.finish(err)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		dwarflog.Error(err, sqlStr, args)
+		return false, Classify(err)
+	}
+
+	return true, nil
+}
+
+func sum(ctx context.Context, db *Mysql, q queryer, table string, column string, condition map[string]interface{}) (float64, error) {
+	condition, err := db.prepareCondition(ctx, table, condition)
+	if err != nil {
+		return 0, err
+	}
+
+	sqlStr, args := buildSelect("SUM(`"+column+"`)", table, condition)
+
+	db.explain(ctx, sqlStr, args)
+
+	st, err := db.guard(ctx, table, sqlStr)
+	if err != nil {
+		return 0, err
+	}
+
+	var total sql.NullFloat64
+	err = q.QueryRowContext(st.ctx, st.query, args...).Scan(&total)
+	st.finish(err)
+	if err != nil {
+		dwarflog.Error(err, sqlStr, args)
+		return 0, Classify(err)
+	}
+
+	return total.Float64, nil
+}
+
+func aggregate(ctx context.Context, db *Mysql, q queryer, fn string, table string, column string, condition map[string]interface{}, dest interface{}) error {
+	condition, err := db.prepareCondition(ctx, table, condition)
+	if err != nil {
+		return err
+	}
+
+	sqlStr, args := buildSelect(fn+"(`"+column+"`)", table, condition)
+
+	db.explain(ctx, sqlStr, args)
+
+	st, err := db.guard(ctx, table, sqlStr)
+	if err != nil {
+		return err
+	}
+
+	err = q.QueryRowContext(st.ctx, st.query, args...).Scan(dest)
+	st.finish(err)
+	if err != nil {
+		dwarflog.Error(err, sqlStr, args)
+		return Classify(err)
+	}
+
+	return nil
+}
+
+/*
+ * Count
+ */
+func (db *Mysql) Count(table string, condition map[string]interface{}) (int64, error) {
+	return db.CountContext(context.Background(), table, condition)
+}
+
+func (db *Mysql) CountContext(ctx context.Context, table string, condition map[string]interface{}) (int64, error) {
+	p, done := db.acquire()
+	defer done()
+
+	return count(ctx, db, p.db, table, condition)
+}
+
+/*
+ * Exists reports whether any row matches condition.
+ */
+func (db *Mysql) Exists(table string, condition map[string]interface{}) (bool, error) {
+	return db.ExistsContext(context.Background(), table, condition)
+}
+
+func (db *Mysql) ExistsContext(ctx context.Context, table string, condition map[string]interface{}) (bool, error) {
+	p, done := db.acquire()
+	defer done()
+
+	return exists(ctx, db, p.db, table, condition)
+}
+
+/*
+ * Sum returns 0 when no row matches. The float64 is not exact for DECIMAL
+ * columns such as money, use SumInto for them.
+ */
+func (db *Mysql) Sum(table string, column string, condition map[string]interface{}) (float64, error) {
+	return db.SumContext(context.Background(), table, column, condition)
+}
+
+func (db *Mysql) SumContext(ctx context.Context, table string, column string, condition map[string]interface{}) (float64, error) {
+	p, done := db.acquire()
+	defer done()
+
+	return sum(ctx, db, p.db, table, column, condition)
+}
+
+/*
+ * SumInto scans the sum of column into dest, see Max for dest. A DECIMAL
+ * sum scanned into a *sql.NullString keeps every digit.
+ */
+func (db *Mysql) SumInto(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return db.SumIntoContext(context.Background(), table, column, condition, dest)
+}
+
+func (db *Mysql) SumIntoContext(ctx context.Context, table string, column string, condition map[string]interface{}, dest interface{}) error {
+	p, done := db.acquire()
+	defer done()
+
+	return aggregate(ctx, db, p.db, "SUM", table, column, condition, dest)
+}
+
+/*
+ * Max scans the maximum of column into dest. MAX is NULL when no row
+ * matches, so dest should be a sql.Null* value or a pointer to pointer,
+ * e.g. *sql.NullInt64 or **time.Time.
+ */
+func (db *Mysql) Max(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return db.MaxContext(context.Background(), table, column, condition, dest)
+}
+
+func (db *Mysql) MaxContext(ctx context.Context, table string, column string, condition map[string]interface{}, dest interface{}) error {
+	p, done := db.acquire()
+	defer done()
+
+	return aggregate(ctx, db, p.db, "MAX", table, column, condition, dest)
+}
+
+/*
+ * Min, see Max for dest.
+ */
+func (db *Mysql) Min(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return db.MinContext(context.Background(), table, column, condition, dest)
+}
+
+func (db *Mysql) MinContext(ctx context.Context, table string, column string, condition map[string]interface{}, dest interface{}) error {
+	p, done := db.acquire()
+	defer done()
+
+	return aggregate(ctx, db, p.db, "MIN", table, column, condition, dest)
+}
+
+func Count(table string, condition map[string]interface{}) (int64, error) {
+	return mysql.Count(table, condition)
+}
+
+func Exists(table string, condition map[string]interface{}) (bool, error) {
+	return mysql.Exists(table, condition)
+}
+
+func Sum(table string, column string, condition map[string]interface{}) (float64, error) {
+	return mysql.Sum(table, column, condition)
+}
+
+func SumInto(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return mysql.SumInto(table, column, condition, dest)
+}
+
+func Max(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return mysql.Max(table, column, condition, dest)
+}
+
+func Min(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return mysql.Min(table, column, condition, dest)
+}
+
+func CountContext(ctx context.Context, table string, condition map[string]interface{}) (int64, error) {
+	return mysql.CountContext(ctx, table, condition)
+}
+
+func ExistsContext(ctx context.Context, table string, condition map[string]interface{}) (bool, error) {
+	return mysql.ExistsContext(ctx, table, condition)
+}
+
+func SumContext(ctx context.Context, table string, column string, condition map[string]interface{}) (float64, error) {
+	return mysql.SumContext(ctx, table, column, condition)
+}
+
+func SumIntoContext(ctx context.Context, table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return mysql.SumIntoContext(ctx, table, column, condition, dest)
+}
+
+func MaxContext(ctx context.Context, table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return mysql.MaxContext(ctx, table, column, condition, dest)
+}
+
+func MinContext(ctx context.Context, table string, column string, condition map[string]interface{}, dest interface{}) error {
+	return mysql.MinContext(ctx, table, column, condition, dest)
+}
+
+func (i *TxInstance) Count(table string, condition map[string]interface{}) (int64, error) {
+	q, err := i.queryer()
+	if err != nil {
+		return 0, err
+	}
+	return count(i.txContext(), i.db, q, table, condition)
+}
+
+func (i *TxInstance) Exists(table string, condition map[string]interface{}) (bool, error) {
+	q, err := i.queryer()
+	if err != nil {
+		return false, err
+	}
+	return exists(i.txContext(), i.db, q, table, condition)
+}
+
+func (i *TxInstance) Sum(table string, column string, condition map[string]interface{}) (float64, error) {
+	q, err := i.queryer()
+	if err != nil {
+		return 0, err
+	}
+	return sum(i.txContext(), i.db, q, table, column, condition)
+}
+
+func (i *TxInstance) SumInto(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	q, err := i.queryer()
+	if err != nil {
+		return err
+	}
+	return aggregate(i.txContext(), i.db, q, "SUM", table, column, condition, dest)
+}
+
+func (i *TxInstance) Max(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	q, err := i.queryer()
+	if err != nil {
+		return err
+	}
+	return aggregate(i.txContext(), i.db, q, "MAX", table, column, condition, dest)
+}
+
+func (i *TxInstance) Min(table string, column string, condition map[string]interface{}, dest interface{}) error {
+	q, err := i.queryer()
+	if err != nil {
+		return err
+	}
+	return aggregate(i.txContext(), i.db, q, "MIN", table, column, condition, dest)
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"strings"
+)
+
+const (
+	AuditInsert = "insert"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditTable receives one row per changed record of the audited tables.
+var AuditTable = "db_audit"
+
+const auditSchema = "CREATE TABLE IF NOT EXISTS `%s` (" +
+	"`id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT," +
+	"`actor` VARCHAR(128) NOT NULL DEFAULT ''," +
+	"`action` VARCHAR(16) NOT NULL," +
+	"`table_name` VARCHAR(64) NOT NULL," +
+	"`pk` VARCHAR(64) NOT NULL," +
+	"`before_data` MEDIUMTEXT NULL," +
+	"`after_data` MEDIUMTEXT NULL," +
+	"`created_at` DATETIME(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3)," +
+	"PRIMARY KEY (`id`)," +
+	"KEY `idx_table_pk` (`table_name`, `pk`)" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+type actorKey struct{}
+
+// WithActor tags ctx with who is making the changes, e.g. in a request middleware.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// CreateAudit creates AuditTable if it does not exist.
+func (db *Mysql) CreateAudit() error {
+	_, err := db.Exec(fmt.Sprintf(auditSchema, AuditTable))
+	return err
+}
+
+/*
+ * Audit
+ *
+ * Records every Add, Update and Delete on table into AuditTable with the
+ * actor of the context (see WithActor), the primary key and the before and
+ * after values as json. Audit rows are written in the tx of the change:
+ * writes made outside a TxInstance run in a tx of their own. Update and
+ * Delete lock the matching rows to read their before values, and Add and
+ * Update read the written rows back by primary key for the after values, so
+ * both images hold the values as stored: encrypted columns appear as cipher
+ * text, and expressions such as JSONSet as their result.
+ *
+ * Changes made with raw Exec are not audited.
+ */
+func (db *Mysql) Audit(table string, primaryKey string) {
+	if db.audits == nil {
+		db.audits = make(map[string]string)
+	}
+	db.audits[table] = primaryKey
+}
+
+func Audit(table string, primaryKey string) {
+	mysql.Audit(table, primaryKey)
+}
+
+func (db *Mysql) audited(table string) bool {
+	_, ok := db.audits[table]
+	return ok
+}
+
+func (i *TxInstance) auditKey(table string) (string, bool) {
+	if i.db == nil {
+		return "", false
+	}
+
+	pk, ok := i.db.audits[table]
+	return pk, ok
+}
+
+// auditSnapshot locks and reads the rows matching condition of an audited table.
+func (i *TxInstance) auditSnapshot(ctx context.Context, table string, condition map[string]interface{}) ([]map[string]interface{}, error) {
+	if _, ok := i.auditKey(table); !ok || i.Tx == nil {
+		return nil, nil
+	}
+
+	sqlStr, args := buildSelect("*", table, condition)
+	sqlStr += " FOR UPDATE"
+
+	rows, err := i.Tx.QueryContext(ctx, sqlStr, args...)
+	if err != nil {
+		dwarflog.Error(err, sqlStr, args)
+		return nil, Classify(err)
+	}
+	defer rows.Close()
+
+	return ScanMaps(rows)
+}
+
+func (i *TxInstance) auditInsert(ctx context.Context, table string, lastInsertId int64, insertData map[string]interface{}) error {
+	pk, ok := i.auditKey(table)
+	if !ok {
+		return nil
+	}
+
+	var key interface{} = lastInsertId
+	if v, ok := insertData[pk]; ok {
+		key = v
+	}
+
+	after, err := i.auditImage(ctx, table, pk, []interface{}{key})
+	if err != nil {
+		return err
+	}
+
+	return i.writeAudit(ctx, AuditInsert, table, key, nil, after[fmt.Sprint(key)])
+}
+
+func (i *TxInstance) auditUpdate(ctx context.Context, table string, before []map[string]interface{}, updateData map[string]interface{}) error {
+	pk, ok := i.auditKey(table)
+	if !ok {
+		return nil
+	}
+
+	// the key the rows have after the write
+	keys := make([]interface{}, len(before))
+	for n, row := range before {
+		keys[n] = row[pk]
+		if v, ok := updateData[pk]; ok {
+			keys[n] = v
+		}
+	}
+
+	after, err := i.auditImage(ctx, table, pk, keys)
+	if err != nil {
+		return err
+	}
+
+	for n, row := range before {
+		if err := i.writeAudit(ctx, AuditUpdate, table, row[pk], row, after[fmt.Sprint(keys[n])]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// auditImage reads back the rows of table whose primary key is in keys, by the string of their key.
+func (i *TxInstance) auditImage(ctx context.Context, table string, pk string, keys []interface{}) (map[string]map[string]interface{}, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var sqlStr string = "SELECT * FROM " + table + " WHERE `" + pk + "` IN (" + strings.TrimSuffix(strings.Repeat("?,", len(keys)), ",") + ")"
+
+	rows, err := i.Tx.QueryContext(ctx, sqlStr, keys...)
+	if err != nil {
+		dwarflog.Error(err, sqlStr, keys)
+		return nil, Classify(err)
+	}
+	defer rows.Close()
+
+	image, err := ScanMaps(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]map[string]interface{}, len(image))
+	for _, row := range image {
+		byKey[fmt.Sprint(row[pk])] = row
+	}
+
+	return byKey, nil
+}
+
+func (i *TxInstance) auditDelete(ctx context.Context, table string, before []map[string]interface{}) error {
+	pk, ok := i.auditKey(table)
+	if !ok {
+		return nil
+	}
+
+	for _, row := range before {
+		if err := i.writeAudit(ctx, AuditDelete, table, row[pk], row, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *TxInstance) writeAudit(ctx context.Context, action string, table string, pk interface{}, before map[string]interface{}, after map[string]interface{}) error {
+	row := map[string]interface{}{
+		"actor":       ActorFromContext(ctx),
+		"action":      action,
+		"table_name":  table,
+		"pk":          fmt.Sprint(pk),
+		"before_data": nil,
+		"after_data":  nil,
+	}
+
+	if before != nil {
+		data, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		row["before_data"] = string(data)
+	}
+	if after != nil {
+		data, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		row["after_data"] = string(data)
+	}
+
+	sqlStr, args := buildInsert(AuditTable, row)
+	if _, err := i.exec(ctx, sqlStr, args...); err != nil {
+		dwarflog.Error(err, sqlStr, args)
+		return Classify(err)
+	}
+
+	return nil
+}
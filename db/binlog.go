@@ -0,0 +1,542 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type RowAction string
+
+const (
+	RowInsert = RowAction("insert")
+	RowUpdate = RowAction("update")
+	RowDelete = RowAction("delete")
+)
+
+var (
+	ErrBinlogChecksum = errors.New("binlog event checksum mismatch")
+	ErrBinlogFile     = errors.New("not a binlog file")
+)
+
+var binlogMagic = []byte{0xfe, 'b', 'i', 'n'}
+
+type BinlogPosition struct {
+	File string
+	Pos  uint32
+}
+
+func (p BinlogPosition) IsZero() bool {
+	return p.File == "" && p.Pos == 0
+}
+
+/*
+ * RowEvent is one changed row. Before is nil for inserts and After for
+ * deletes. Values are int64 (uint64 for unsigned columns), float64, string
+ * for text, DECIMAL, DATE, TIME and DATETIME, time.Time (UTC) for TIMESTAMP,
+ * and the raw MySQL binary encoding for JSON.
+ */
+type RowEvent struct {
+	Action   RowAction
+	Schema   string
+	Table    string
+	Before   map[string]interface{}
+	After    map[string]interface{}
+	Time     time.Time
+	Position BinlogPosition // end of the rows event
+}
+
+type RowHandler func(ctx context.Context, event RowEvent) error
+
+// BinlogStreamer yields raw binlog events, header included.
+type BinlogStreamer interface {
+	// Start streams from pos, or from the current end of the binlog when pos is zero.
+	Start(ctx context.Context, pos BinlogPosition) error
+	// ReadEvent returns the next event, io.EOF when the stream is over.
+	ReadEvent(ctx context.Context) ([]byte, error)
+	Close() error
+}
+
+// ColumnResolver names the columns of a table in ordinal order, for servers without binlog_row_metadata=FULL.
+type ColumnResolver interface {
+	Columns(ctx context.Context, schema string, table string) ([]string, error)
+}
+
+type ColumnResolverFunc func(ctx context.Context, schema string, table string) ([]string, error)
+
+func (f ColumnResolverFunc) Columns(ctx context.Context, schema string, table string) ([]string, error) {
+	return f(ctx, schema, table)
+}
+
+// Columns reads the column names from information_schema.
+func (db *Mysql) Columns(ctx context.Context, schema string, table string) ([]string, error) {
+	var sqlStr string = "SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION"
+
+	rows, err := db.QueryContext(ctx, sqlStr, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+type Checkpoint interface {
+	Load() (BinlogPosition, error)
+	Save(pos BinlogPosition) error
+}
+
+// FileCheckpoint keeps the position in a json file, replaced atomically on Save.
+type FileCheckpoint struct {
+	Path string
+}
+
+func NewFileCheckpoint(path string) *FileCheckpoint {
+	return &FileCheckpoint{Path: path}
+}
+
+func (c *FileCheckpoint) Load() (BinlogPosition, error) {
+	var pos BinlogPosition
+
+	data, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return pos, nil
+	}
+	if err != nil {
+		return pos, err
+	}
+
+	err = json.Unmarshal(data, &pos)
+	return pos, err
+}
+
+func (c *FileCheckpoint) Save(pos BinlogPosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
+
+/*
+ * CDC
+ *
+ * Tails the binlog and hands every changed row to the handlers of its table,
+ * replacing polling on updated_at. The server must run with binlog_format=ROW
+ * and binlog_row_image=FULL (with MINIMAL the images only hold the logged
+ * columns).
+ *
+ * The position is checkpointed at the end of every tx whose rows all went
+ * through the handlers. Delivery is at least once: after a crash or a
+ * handler error, Run resumes at the start of the unfinished tx.
+ */
+type CDC struct {
+	streamer   BinlogStreamer
+	columns    ColumnResolver
+	checkpoint Checkpoint
+	handlers   map[string][]RowHandler
+
+	names    map[string][]string // schema.table to column names
+	tables   map[uint64]*tableMap
+	checksum bool
+	seenFDE  bool
+	position BinlogPosition
+}
+
+/*
+ * NewCDC tails config's server as replica serverId, which must differ from
+ * the server ids of the source and the other replicas. The user needs the
+ * REPLICATION SLAVE and REPLICATION CLIENT privileges.
+ */
+func NewCDC(config MysqlConfig, serverId uint32, checkpoint Checkpoint) *CDC {
+	return NewCDCStreamer(NewReplicaStreamer(config, serverId), NewMysql(config), checkpoint)
+}
+
+// NewCDCStreamer reads events from streamer instead, e.g. a BinlogFile in tests.
+func NewCDCStreamer(streamer BinlogStreamer, columns ColumnResolver, checkpoint Checkpoint) *CDC {
+	return &CDC{
+		streamer:   streamer,
+		columns:    columns,
+		checkpoint: checkpoint,
+		handlers:   make(map[string][]RowHandler),
+		names:      make(map[string][]string),
+	}
+}
+
+// Handle registers handler for table, "schema.table", or "*" for every table.
+func (c *CDC) Handle(table string, handler RowHandler) {
+	c.handlers[table] = append(c.handlers[table], handler)
+}
+
+func (c *CDC) handlersOf(schema string, table string) []RowHandler {
+	var handlers []RowHandler
+	handlers = append(handlers, c.handlers[schema+"."+table]...)
+	handlers = append(handlers, c.handlers[table]...)
+	handlers = append(handlers, c.handlers["*"]...)
+	return handlers
+}
+
+// Position is the last checkpointed position.
+func (c *CDC) Position() BinlogPosition {
+	return c.position
+}
+
+// Run streams from the checkpoint until ctx is done, the stream ends or a handler fails.
+func (c *CDC) Run(ctx context.Context) error {
+	pos, err := c.checkpoint.Load()
+	if err != nil {
+		return err
+	}
+	c.position = pos
+	c.tables = make(map[uint64]*tableMap)
+	c.checksum, c.seenFDE = false, false
+
+	if err := c.streamer.Start(ctx, pos); err != nil {
+		return err
+	}
+	defer c.streamer.Close()
+
+	for {
+		event, err := c.streamer.ReadEvent(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		if err := c.process(ctx, event); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *CDC) process(ctx context.Context, event []byte) error {
+	header, err := parseBinlogHeader(event)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.body(header, event)
+	if err != nil {
+		return err
+	}
+
+	switch header.Type {
+	case binlogFormatDescriptionEvent:
+		c.seenFDE = true
+		c.checksum, err = parseFormatDescription(body)
+		return err
+
+	case binlogRotateEvent:
+		next, err := parseRotate(body)
+		if err != nil {
+			return err
+		}
+		c.position.File = next.File
+		if next.Pos > 0 && header.LogPos == 0 {
+			// the artificial rotate at the start of a stream
+			c.position.Pos = next.Pos
+		}
+		return nil
+
+	case binlogTableMapEvent:
+		tableId, m, err := parseTableMap(body)
+		if err != nil {
+			return err
+		}
+		if len(c.handlersOf(m.Schema, m.Table)) == 0 {
+			delete(c.tables, tableId)
+			return nil
+		}
+		if len(m.Names) < len(m.Types) {
+			if m.Names, err = c.columnNames(ctx, m.Schema, m.Table); err != nil {
+				return err
+			}
+		}
+		c.tables[tableId] = m
+		return nil
+
+	case binlogWriteRowsEventV1, binlogUpdateRowsEventV1, binlogDeleteRowsEventV1,
+		binlogWriteRowsEventV2, binlogUpdateRowsEventV2, binlogDeleteRowsEventV2:
+		r := &binlogReader{buf: body}
+		if _, ok := c.tables[r.uint(6)]; !ok {
+			// no handler for the table
+			return nil
+		}
+		rows, m, err := parseRows(header.Type, body, c.tables)
+		if err != nil {
+			return err
+		}
+		return c.dispatch(ctx, header, rows, m)
+
+	case binlogXidEvent:
+		return c.save(header)
+
+	case binlogQueryEvent:
+		query, err := parseQuery(body)
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(strings.TrimSpace(query), "BEGIN") {
+			return nil
+		}
+		// DDL commits on its own and may change the columns
+		c.names = make(map[string][]string)
+		return c.save(header)
+	}
+
+	return nil
+}
+
+// body strips the header and the checksum, verifying it.
+func (c *CDC) body(header binlogHeader, event []byte) ([]byte, error) {
+	checksum := c.checksum
+	if !c.seenFDE && header.Type == binlogRotateEvent && len(event) > binlogHeaderSize+4 {
+		// the checksum setting comes with the first format description, after the first rotate
+		checksum = validChecksum(event)
+	}
+	if header.Type == binlogFormatDescriptionEvent {
+		return event[binlogHeaderSize:], nil
+	}
+
+	if !checksum {
+		return event[binlogHeaderSize:], nil
+	}
+
+	if len(event) < binlogHeaderSize+4 {
+		return nil, errBinlogShort
+	}
+	if !validChecksum(event) {
+		return nil, ErrBinlogChecksum
+	}
+	return event[binlogHeaderSize : len(event)-4], nil
+}
+
+func validChecksum(event []byte) bool {
+	n := len(event) - 4
+	return crc32.ChecksumIEEE(event[:n]) == binary.LittleEndian.Uint32(event[n:])
+}
+
+func (c *CDC) columnNames(ctx context.Context, schema string, table string) ([]string, error) {
+	key := schema + "." + table
+	if names, ok := c.names[key]; ok {
+		return names, nil
+	}
+
+	if c.columns == nil {
+		return nil, nil
+	}
+
+	names, err := c.columns.Columns(ctx, schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("columns of %s: %v", key, err)
+	}
+	c.names[key] = names
+
+	return names, nil
+}
+
+func (c *CDC) dispatch(ctx context.Context, header binlogHeader, rows *rowsEvent, m *tableMap) error {
+	handlers := c.handlersOf(m.Schema, m.Table)
+
+	for _, row := range rows.Rows {
+		event := RowEvent{
+			Action:   rows.Action,
+			Schema:   m.Schema,
+			Table:    m.Table,
+			Before:   row[0],
+			After:    row[1],
+			Time:     time.Unix(int64(header.Timestamp), 0),
+			Position: BinlogPosition{File: c.position.File, Pos: header.LogPos},
+		}
+
+		for _, handler := range handlers {
+			if err := handler(ctx, event); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *CDC) save(header binlogHeader) error {
+	if header.LogPos == 0 {
+		return nil
+	}
+
+	pos := BinlogPosition{File: c.position.File, Pos: header.LogPos}
+	if err := c.checkpoint.Save(pos); err != nil {
+		return err
+	}
+	c.position = pos
+
+	return nil
+}
+
+/*
+ * BinlogFile
+ *
+ * Replays a binlog file, e.g. one copied from the server's datadir or written
+ * by RecordBinlog, as a local stand-in for the replica stream. Like the
+ * server it starts with a rotate to the file and resends the format
+ * description when resuming mid-file.
+ */
+type BinlogFile struct {
+	path   string
+	file   *os.File
+	events [][]byte
+}
+
+func NewBinlogFile(path string) *BinlogFile {
+	return &BinlogFile{path: path}
+}
+
+func (f *BinlogFile) Start(ctx context.Context, pos BinlogPosition) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	f.file = file
+
+	magic := make([]byte, len(binlogMagic))
+	if _, err := io.ReadFull(file, magic); err != nil || !bytes.Equal(magic, binlogMagic) {
+		return ErrBinlogFile
+	}
+
+	name := filepath.Base(f.path)
+	f.events = [][]byte{artificialRotate(name, 4)}
+
+	for {
+		event, err := readBinlogEvent(file)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		header, _ := parseBinlogHeader(event)
+		if header.Type == binlogFormatDescriptionEvent || pos.Pos == 0 || pos.File != name || header.LogPos > pos.Pos {
+			f.events = append(f.events, event)
+		}
+	}
+}
+
+func (f *BinlogFile) ReadEvent(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(f.events) == 0 {
+		return nil, io.EOF
+	}
+
+	event := f.events[0]
+	f.events = f.events[1:]
+	return event, nil
+}
+
+func (f *BinlogFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+func readBinlogEvent(r io.Reader) ([]byte, error) {
+	header := make([]byte, binlogHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errBinlogShort
+		}
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[9:13])
+	if size < binlogHeaderSize {
+		return nil, errBinlogShort
+	}
+
+	event := make([]byte, size)
+	copy(event, header)
+	if _, err := io.ReadFull(r, event[binlogHeaderSize:]); err != nil {
+		return nil, errBinlogShort
+	}
+
+	return event, nil
+}
+
+// artificialRotate is the rotate event a server sends first, without a checksum.
+func artificialRotate(name string, pos uint64) []byte {
+	event := make([]byte, binlogHeaderSize+8+len(name))
+	event[4] = binlogRotateEvent
+	binary.LittleEndian.PutUint32(event[9:], uint32(len(event)))
+	binary.LittleEndian.PutUint16(event[17:], 0x20) // LOG_EVENT_ARTIFICIAL_F
+	binary.LittleEndian.PutUint64(event[binlogHeaderSize:], pos)
+	copy(event[binlogHeaderSize+8:], name)
+	return event
+}
+
+// RecordBinlog copies the events read from streamer to w as a binlog file, to build fixtures for BinlogFile.
+func RecordBinlog(streamer BinlogStreamer, w io.Writer) BinlogStreamer {
+	return &binlogRecorder{BinlogStreamer: streamer, w: w}
+}
+
+type binlogRecorder struct {
+	BinlogStreamer
+	w      io.Writer
+	header bool
+}
+
+func (r *binlogRecorder) ReadEvent(ctx context.Context) ([]byte, error) {
+	event, err := r.BinlogStreamer.ReadEvent(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.header {
+		if _, err := r.w.Write(binlogMagic); err != nil {
+			return nil, err
+		}
+		r.header = true
+	}
+
+	header, _ := parseBinlogHeader(event)
+	if header.Type == binlogRotateEvent && header.Flags&0x20 != 0 {
+		// the file name is the rotate BinlogFile starts with
+		return event, nil
+	}
+	if _, err := r.w.Write(event); err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
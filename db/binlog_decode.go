@@ -0,0 +1,644 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// binlog event types, see https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_replication_binlog_event.html
+const (
+	binlogQueryEvent             = 2
+	binlogRotateEvent            = 4
+	binlogFormatDescriptionEvent = 15
+	binlogXidEvent               = 16
+	binlogTableMapEvent          = 19
+	binlogWriteRowsEventV1       = 23
+	binlogUpdateRowsEventV1      = 24
+	binlogDeleteRowsEventV1      = 25
+	binlogHeartbeatEvent         = 27
+	binlogWriteRowsEventV2       = 30
+	binlogUpdateRowsEventV2      = 31
+	binlogDeleteRowsEventV2      = 32
+
+	binlogHeaderSize = 19
+)
+
+// column types
+const (
+	mysqlTypeDecimal    = 0
+	mysqlTypeTiny       = 1
+	mysqlTypeShort      = 2
+	mysqlTypeLong       = 3
+	mysqlTypeFloat      = 4
+	mysqlTypeDouble     = 5
+	mysqlTypeNull       = 6
+	mysqlTypeTimestamp  = 7
+	mysqlTypeLongLong   = 8
+	mysqlTypeInt24      = 9
+	mysqlTypeDate       = 10
+	mysqlTypeTime       = 11
+	mysqlTypeDatetime   = 12
+	mysqlTypeYear       = 13
+	mysqlTypeVarchar    = 15
+	mysqlTypeBit        = 16
+	mysqlTypeTimestamp2 = 17
+	mysqlTypeDatetime2  = 18
+	mysqlTypeTime2      = 19
+	mysqlTypeJSON       = 245
+	mysqlTypeNewDecimal = 246
+	mysqlTypeEnum       = 247
+	mysqlTypeSet        = 248
+	mysqlTypeTinyBlob   = 249
+	mysqlTypeMediumBlob = 250
+	mysqlTypeLongBlob   = 251
+	mysqlTypeBlob       = 252
+	mysqlTypeVarString  = 253
+	mysqlTypeString     = 254
+	mysqlTypeGeometry   = 255
+)
+
+// table map optional metadata fields
+const (
+	tableMapSignedness = 1
+	tableMapColumnName = 4
+)
+
+var errBinlogShort = errors.New("binlog event too short")
+
+type binlogHeader struct {
+	Timestamp uint32
+	Type      byte
+	ServerId  uint32
+	EventSize uint32
+	LogPos    uint32
+	Flags     uint16
+}
+
+type tableMap struct {
+	Schema   string
+	Table    string
+	Types    []byte
+	Meta     []uint16
+	Unsigned []bool
+	Names    []string // only with binlog_row_metadata=FULL
+}
+
+// column names the i-th column like mysqlbinlog does when its name is unknown.
+func (m *tableMap) column(i int) string {
+	if i < len(m.Names) && m.Names[i] != "" {
+		return m.Names[i]
+	}
+	return "@" + strconv.Itoa(i+1)
+}
+
+type rowsEvent struct {
+	TableId uint64
+	Action  RowAction
+	Rows    [][2]map[string]interface{} // before and after images
+}
+
+// binlogReader walks a little-endian event body.
+type binlogReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *binlogReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.buf) {
+		r.err = errBinlogShort
+		return nil
+	}
+
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *binlogReader) remaining() int {
+	return len(r.buf) - r.pos
+}
+
+func (r *binlogReader) uint(n int) uint64 {
+	b := r.take(n)
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+// bigEndian reads the big-endian integers of the temporal and decimal formats.
+func (r *binlogReader) bigEndian(n int) uint64 {
+	var v uint64
+	for _, c := range r.take(n) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func (r *binlogReader) lenenc() uint64 {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+
+	switch b[0] {
+	case 0xfc:
+		return r.uint(2)
+	case 0xfd:
+		return r.uint(3)
+	case 0xfe:
+		return r.uint(8)
+	}
+	return uint64(b[0])
+}
+
+func parseBinlogHeader(event []byte) (binlogHeader, error) {
+	if len(event) < binlogHeaderSize {
+		return binlogHeader{}, errBinlogShort
+	}
+
+	r := &binlogReader{buf: event}
+	return binlogHeader{
+		Timestamp: uint32(r.uint(4)),
+		Type:      byte(r.uint(1)),
+		ServerId:  uint32(r.uint(4)),
+		EventSize: uint32(r.uint(4)),
+		LogPos:    uint32(r.uint(4)),
+		Flags:     uint16(r.uint(2)),
+	}, nil
+}
+
+// parseFormatDescription reports whether the following events carry a crc32 checksum.
+func parseFormatDescription(body []byte) (bool, error) {
+	r := &binlogReader{buf: body}
+	r.take(2)
+	version := strings.TrimRight(string(r.take(50)), "\x00")
+	r.take(4 + 1)
+	if r.err != nil {
+		return false, r.err
+	}
+
+	// servers since 5.6.1 append the checksum algorithm and the event's own checksum
+	if !versionAtLeast(version, 5, 6, 1) || len(body) < 5 {
+		return false, nil
+	}
+
+	return body[len(body)-5] == 1, nil
+}
+
+func versionAtLeast(version string, major, minor, patch int) bool {
+	parts := strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3)
+	want := []int{major, minor, patch}
+	for i, w := range want {
+		if i >= len(parts) {
+			return false
+		}
+		n, _ := strconv.Atoi(parts[i])
+		if n != w {
+			return n > w
+		}
+	}
+	return true
+}
+
+func parseRotate(body []byte) (BinlogPosition, error) {
+	r := &binlogReader{buf: body}
+	pos := r.uint(8)
+	if r.err != nil {
+		return BinlogPosition{}, r.err
+	}
+
+	return BinlogPosition{File: string(body[8:]), Pos: uint32(pos)}, nil
+}
+
+// parseQuery returns the statement of a query event, used to spot DDL.
+func parseQuery(body []byte) (string, error) {
+	r := &binlogReader{buf: body}
+	r.take(4 + 4)
+	schemaLen := int(r.uint(1))
+	r.take(2)
+	statusLen := int(r.uint(2))
+	r.take(statusLen)
+	r.take(schemaLen + 1)
+	if r.err != nil {
+		return "", r.err
+	}
+
+	return string(body[r.pos:]), nil
+}
+
+func parseTableMap(body []byte) (uint64, *tableMap, error) {
+	r := &binlogReader{buf: body}
+	tableId := r.uint(6)
+	r.take(2)
+
+	m := &tableMap{}
+	m.Schema = string(r.take(int(r.uint(1))))
+	r.take(1)
+	m.Table = string(r.take(int(r.uint(1))))
+	r.take(1)
+
+	count := int(r.lenenc())
+	m.Types = append([]byte(nil), r.take(count)...)
+
+	meta := &binlogReader{buf: r.take(int(r.lenenc()))}
+	m.Meta = make([]uint16, count)
+	for i, t := range m.Types {
+		switch t {
+		case mysqlTypeFloat, mysqlTypeDouble, mysqlTypeBlob, mysqlTypeGeometry, mysqlTypeJSON,
+			mysqlTypeTimestamp2, mysqlTypeDatetime2, mysqlTypeTime2:
+			m.Meta[i] = uint16(meta.uint(1))
+		case mysqlTypeVarchar, mysqlTypeVarString, mysqlTypeBit:
+			m.Meta[i] = uint16(meta.uint(2))
+		case mysqlTypeNewDecimal, mysqlTypeString, mysqlTypeEnum, mysqlTypeSet:
+			// precision and scale, or real type and length, first byte high
+			m.Meta[i] = uint16(meta.bigEndian(2))
+		}
+	}
+	if meta.err != nil {
+		return 0, nil, meta.err
+	}
+
+	r.take((count + 7) / 8) // nullability
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+
+	m.Unsigned = make([]bool, count)
+	for r.remaining() > 0 {
+		fieldType := r.uint(1)
+		field := &binlogReader{buf: r.take(int(r.lenenc()))}
+		if r.err != nil {
+			break
+		}
+
+		switch fieldType {
+		case tableMapSignedness:
+			// one bit per numeric column, most significant first
+			var n int
+			for i, t := range m.Types {
+				if !isNumericType(t) {
+					continue
+				}
+				if n/8 < len(field.buf) && field.buf[n/8]&(0x80>>uint(n%8)) != 0 {
+					m.Unsigned[i] = true
+				}
+				n++
+			}
+		case tableMapColumnName:
+			for field.remaining() > 0 && field.err == nil {
+				m.Names = append(m.Names, string(field.take(int(field.lenenc()))))
+			}
+		}
+	}
+
+	return tableId, m, nil
+}
+
+func isNumericType(t byte) bool {
+	switch t {
+	case mysqlTypeTiny, mysqlTypeShort, mysqlTypeInt24, mysqlTypeLong, mysqlTypeLongLong,
+		mysqlTypeFloat, mysqlTypeDouble, mysqlTypeNewDecimal, mysqlTypeDecimal:
+		return true
+	}
+	return false
+}
+
+func bitmapSet(bitmap []byte, i int) bool {
+	return bitmap[i/8]&(1<<uint(i%8)) != 0
+}
+
+func parseRows(eventType byte, body []byte, tables map[uint64]*tableMap) (*rowsEvent, *tableMap, error) {
+	r := &binlogReader{buf: body}
+	e := &rowsEvent{TableId: r.uint(6)}
+	r.take(2)
+
+	switch eventType {
+	case binlogWriteRowsEventV1, binlogWriteRowsEventV2:
+		e.Action = RowInsert
+	case binlogUpdateRowsEventV1, binlogUpdateRowsEventV2:
+		e.Action = RowUpdate
+	default:
+		e.Action = RowDelete
+	}
+
+	if eventType >= binlogWriteRowsEventV2 {
+		r.take(int(r.uint(2)) - 2)
+	}
+
+	m, ok := tables[e.TableId]
+	if !ok {
+		return nil, nil, fmt.Errorf("binlog rows event for unknown table id %d", e.TableId)
+	}
+
+	count := int(r.lenenc())
+	present := r.take((count + 7) / 8)
+	presentAfter := present
+	if e.Action == RowUpdate {
+		presentAfter = r.take((count + 7) / 8)
+	}
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+
+	for r.remaining() > 0 {
+		var row [2]map[string]interface{}
+		var err error
+
+		switch e.Action {
+		case RowInsert:
+			row[1], err = parseRowImage(r, m, count, present)
+		case RowDelete:
+			row[0], err = parseRowImage(r, m, count, present)
+		case RowUpdate:
+			if row[0], err = parseRowImage(r, m, count, present); err == nil {
+				row[1], err = parseRowImage(r, m, count, presentAfter)
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		e.Rows = append(e.Rows, row)
+	}
+
+	return e, m, nil
+}
+
+// parseRowImage maps the present columns to their values, nil for NULL.
+func parseRowImage(r *binlogReader, m *tableMap, count int, present []byte) (map[string]interface{}, error) {
+	var presentCount int
+	for i := 0; i < count; i++ {
+		if bitmapSet(present, i) {
+			presentCount++
+		}
+	}
+
+	nulls := r.take((presentCount + 7) / 8)
+	if r.err != nil {
+		return nil, r.err
+	}
+	values := make(map[string]interface{}, presentCount)
+
+	var n int
+	for i := 0; i < count; i++ {
+		if !bitmapSet(present, i) {
+			continue
+		}
+		isNull := bitmapSet(nulls, n)
+		n++
+		if isNull {
+			values[m.column(i)] = nil
+			continue
+		}
+
+		v, err := decodeValue(r, m.Types[i], m.Meta[i], m.Unsigned[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s column %s: %v", m.Schema, m.Table, m.column(i), err)
+		}
+		values[m.column(i)] = v
+	}
+
+	return values, r.err
+}
+
+func decodeValue(r *binlogReader, t byte, meta uint16, unsigned bool) (interface{}, error) {
+	// STRING carries the real type of ENUM and SET in its metadata
+	length := int(meta & 0xff)
+	if t == mysqlTypeString && meta >= 256 {
+		realType := byte(meta >> 8)
+		if realType&0x30 != 0x30 {
+			length |= int((realType&0x30)^0x30) << 4
+			realType |= 0x30
+		}
+		t = realType
+	}
+
+	switch t {
+	case mysqlTypeTiny:
+		v := r.uint(1)
+		if unsigned {
+			return v, r.err
+		}
+		return int64(int8(v)), r.err
+	case mysqlTypeShort:
+		v := r.uint(2)
+		if unsigned {
+			return v, r.err
+		}
+		return int64(int16(v)), r.err
+	case mysqlTypeInt24:
+		v := r.uint(3)
+		if unsigned {
+			return v, r.err
+		}
+		if v&0x800000 != 0 {
+			return int64(v) - 0x1000000, r.err
+		}
+		return int64(v), r.err
+	case mysqlTypeLong:
+		v := r.uint(4)
+		if unsigned {
+			return v, r.err
+		}
+		return int64(int32(v)), r.err
+	case mysqlTypeLongLong:
+		v := r.uint(8)
+		if unsigned {
+			return v, r.err
+		}
+		return int64(v), r.err
+	case mysqlTypeFloat:
+		return float64(math.Float32frombits(uint32(r.uint(4)))), r.err
+	case mysqlTypeDouble:
+		return math.Float64frombits(r.uint(8)), r.err
+	case mysqlTypeYear:
+		v := r.uint(1)
+		if v == 0 {
+			return int64(0), r.err
+		}
+		return int64(v) + 1900, r.err
+	case mysqlTypeNewDecimal:
+		return decodeDecimal(r, int(meta>>8), int(meta&0xff))
+	case mysqlTypeDate:
+		v := r.uint(3)
+		return fmt.Sprintf("%04d-%02d-%02d", v>>9, (v>>5)&15, v&31), r.err
+	case mysqlTypeTime:
+		v := r.uint(3)
+		return fmt.Sprintf("%02d:%02d:%02d", v/10000, (v%10000)/100, v%100), r.err
+	case mysqlTypeDatetime:
+		v := r.uint(8)
+		d, t := v/1000000, v%1000000
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", d/10000, (d%10000)/100, d%100, t/10000, (t%10000)/100, t%100), r.err
+	case mysqlTypeTimestamp:
+		return time.Unix(int64(r.uint(4)), 0).UTC(), r.err
+	case mysqlTypeTimestamp2:
+		sec := r.bigEndian(4)
+		frac := decodeFrac(r, int(meta))
+		return time.Unix(int64(sec), frac*1000).UTC(), r.err
+	case mysqlTypeDatetime2:
+		return decodeDatetime2(r, int(meta))
+	case mysqlTypeTime2:
+		return decodeTime2(r, int(meta))
+	case mysqlTypeVarchar, mysqlTypeVarString:
+		if meta < 256 {
+			return string(r.take(int(r.uint(1)))), r.err
+		}
+		return string(r.take(int(r.uint(2)))), r.err
+	case mysqlTypeString:
+		if length < 256 {
+			return string(r.take(int(r.uint(1)))), r.err
+		}
+		return string(r.take(int(r.uint(2)))), r.err
+	case mysqlTypeEnum:
+		return int64(r.uint(length)), r.err
+	case mysqlTypeSet:
+		return r.uint(length), r.err
+	case mysqlTypeBit:
+		bits := int(meta>>8)*8 + int(meta&0xff)
+		return r.bigEndian((bits + 7) / 8), r.err
+	case mysqlTypeBlob, mysqlTypeGeometry:
+		return string(r.take(int(r.uint(int(meta))))), r.err
+	case mysqlTypeJSON:
+		// MySQL binary json, kept as is
+		return append([]byte(nil), r.take(int(r.uint(int(meta))))...), r.err
+	}
+
+	return nil, fmt.Errorf("unsupported column type %d", t)
+}
+
+// decodeFrac reads the fractional seconds of the temporal types, in microseconds.
+func decodeFrac(r *binlogReader, fsp int) int64 {
+	switch fsp {
+	case 1, 2:
+		return int64(r.bigEndian(1)) * 10000
+	case 3, 4:
+		return int64(r.bigEndian(2)) * 100
+	case 5, 6:
+		return int64(r.bigEndian(3))
+	}
+	return 0
+}
+
+func formatFrac(frac int64, fsp int) string {
+	if fsp == 0 {
+		return ""
+	}
+	return "." + fmt.Sprintf("%06d", frac)[:fsp]
+}
+
+func decodeDatetime2(r *binlogReader, fsp int) (interface{}, error) {
+	intPart := int64(r.bigEndian(5)) - 0x8000000000
+	frac := decodeFrac(r, fsp)
+	if intPart < 0 {
+		intPart = -intPart
+	}
+
+	ymd := intPart >> 17
+	ym := ymd >> 5
+	hms := intPart % (1 << 17)
+
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d%s",
+		ym/13, ym%13, ymd%(1<<5), hms>>12, (hms>>6)%(1<<6), hms%(1<<6), formatFrac(frac, fsp)), r.err
+}
+
+func decodeTime2(r *binlogReader, fsp int) (interface{}, error) {
+	var packed int64
+	switch fsp {
+	case 1, 2:
+		intPart := int64(r.bigEndian(3)) - 0x800000
+		frac := int64(r.bigEndian(1))
+		if intPart < 0 && frac > 0 {
+			intPart++
+			frac -= 0x100
+		}
+		packed = intPart<<24 + frac*10000
+	case 3, 4:
+		intPart := int64(r.bigEndian(3)) - 0x800000
+		frac := int64(r.bigEndian(2))
+		if intPart < 0 && frac > 0 {
+			intPart++
+			frac -= 0x10000
+		}
+		packed = intPart<<24 + frac*100
+	case 5, 6:
+		packed = int64(r.bigEndian(6)) - 0x800000000000
+	default:
+		packed = (int64(r.bigEndian(3)) - 0x800000) << 24
+	}
+
+	var sign string
+	if packed < 0 {
+		sign = "-"
+		packed = -packed
+	}
+
+	hms := packed >> 24
+	frac := packed % (1 << 24)
+
+	return fmt.Sprintf("%s%02d:%02d:%02d%s", sign, (hms>>12)%(1<<10), (hms>>6)%(1<<6), hms%(1<<6), formatFrac(frac, fsp)), r.err
+}
+
+var decimalDigitBytes = []int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+// decodeDecimal returns DECIMAL values as strings to keep their precision.
+func decodeDecimal(r *binlogReader, precision int, scale int) (interface{}, error) {
+	integral := precision - scale
+	uncompIntegral, uncompFractional := integral/9, scale/9
+	compIntegral, compFractional := integral-uncompIntegral*9, scale-uncompFractional*9
+	size := uncompIntegral*4 + decimalDigitBytes[compIntegral] + uncompFractional*4 + decimalDigitBytes[compFractional]
+
+	raw := r.take(size)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	data := append([]byte(nil), raw...)
+	negative := data[0]&0x80 == 0
+	data[0] ^= 0x80
+	if negative {
+		for i := range data {
+			data[i] ^= 0xff
+		}
+	}
+
+	d := &binlogReader{buf: data}
+	var b strings.Builder
+	if negative {
+		b.WriteString("-")
+	}
+
+	var intDigits string
+	if n := decimalDigitBytes[compIntegral]; n > 0 {
+		intDigits = strconv.FormatUint(d.bigEndian(n), 10)
+	}
+	for i := 0; i < uncompIntegral; i++ {
+		intDigits += fmt.Sprintf("%09d", d.bigEndian(4))
+	}
+	intDigits = strings.TrimLeft(intDigits, "0")
+	if intDigits == "" {
+		intDigits = "0"
+	}
+	b.WriteString(intDigits)
+
+	if scale > 0 {
+		b.WriteString(".")
+		for i := 0; i < uncompFractional; i++ {
+			fmt.Fprintf(&b, "%09d", d.bigEndian(4))
+		}
+		if n := decimalDigitBytes[compFractional]; n > 0 {
+			fmt.Fprintf(&b, "%0*d", compFractional, d.bigEndian(n))
+		}
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	binlogNetwork     = "dbbinlog"
+	binlogHeartbeat   = time.Second * 10
+	binlogReadTimeout = binlogHeartbeat * 3
+
+	comBinlogDump    = 0x12
+	comRegisterSlave = 0x15
+	maxPacketSize    = 1<<24 - 1
+)
+
+var ErrBinlogDisabled = errors.New("binlog is not enabled on the server")
+
+var (
+	binlogDialOnce sync.Once
+	binlogConns    sync.Map // dial token to its net.Conn
+	binlogConnSeq  int64
+)
+
+/*
+ * ReplicaStreamer
+ *
+ * Streams the binlog with COM_BINLOG_DUMP. The connection is opened and
+ * authenticated by the mysql driver through a dialer that keeps hold of the
+ * socket, then taken over for the replication protocol. TLS is not
+ * supported, as the driver would wrap the socket.
+ */
+type ReplicaStreamer struct {
+	config   MysqlConfig
+	serverId uint32
+
+	db     *sql.DB
+	conn   *sql.Conn
+	raw    net.Conn
+	reader *bufio.Reader
+	stop   chan struct{}
+}
+
+func NewReplicaStreamer(config MysqlConfig, serverId uint32) *ReplicaStreamer {
+	return &ReplicaStreamer{config: config, serverId: serverId}
+}
+
+func registerBinlogDial() {
+	mysqlDriver.RegisterDialContext(binlogNetwork, func(ctx context.Context, addr string) (net.Conn, error) {
+		i := strings.LastIndex(addr, "|")
+		if i < 0 {
+			return nil, fmt.Errorf("binlog dial address %q has no token", addr)
+		}
+
+		conn, err := (&net.Dialer{KeepAlive: time.Minute}).DialContext(ctx, "tcp", addr[:i])
+		if err != nil {
+			return nil, err
+		}
+		binlogConns.Store(addr[i+1:], conn)
+
+		return conn, nil
+	})
+}
+
+func (s *ReplicaStreamer) Start(ctx context.Context, pos BinlogPosition) error {
+	binlogDialOnce.Do(registerBinlogDial)
+
+	token := strconv.FormatInt(atomic.AddInt64(&binlogConnSeq, 1), 10)
+	var dsn string = fmt.Sprintf("%s:%s@%s(%s:%d|%s)/?charset=utf8mb4", s.config.User, s.config.Password, binlogNetwork, s.config.Host, s.config.Port, token)
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+	// the connection leaves the protocol the driver knows, never pool it
+	db.SetMaxIdleConns(0)
+	s.db = db
+
+	if s.conn, err = db.Conn(ctx); err != nil {
+		s.Close()
+		return Classify(err)
+	}
+
+	raw, ok := binlogConns.Load(token)
+	binlogConns.Delete(token)
+	if !ok {
+		s.Close()
+		return errors.New("binlog connection was not dialed")
+	}
+	s.raw = raw.(net.Conn)
+
+	if err := s.prepare(ctx, &pos); err != nil {
+		s.Close()
+		return err
+	}
+
+	if err := s.command(s.registerSlave()); err != nil {
+		s.Close()
+		return err
+	}
+	if _, err := s.readPacket(); err != nil {
+		s.Close()
+		return err
+	}
+
+	if err := s.command(s.binlogDump(pos)); err != nil {
+		s.Close()
+		return err
+	}
+
+	s.stop = make(chan struct{})
+	go func(stop chan struct{}, raw net.Conn) {
+		select {
+		case <-ctx.Done():
+			raw.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}(s.stop, s.raw)
+
+	return nil
+}
+
+// prepare sets the session up for the dump, and resolves a zero pos to the current end of the binlog.
+func (s *ReplicaStreamer) prepare(ctx context.Context, pos *BinlogPosition) error {
+	var checksum sql.NullString
+	if err := s.conn.QueryRowContext(ctx, "SELECT @@global.binlog_checksum").Scan(&checksum); err == nil && checksum.String != "" && checksum.String != "NONE" {
+		// without it the server refuses to send checksummed events
+		if _, err := s.conn.ExecContext(ctx, "SET @master_binlog_checksum = @@global.binlog_checksum"); err != nil {
+			return Classify(err)
+		}
+	}
+
+	if _, err := s.conn.ExecContext(ctx, "SET @master_heartbeat_period = ?", binlogHeartbeat.Nanoseconds()); err != nil {
+		return Classify(err)
+	}
+
+	if !pos.IsZero() {
+		return nil
+	}
+
+	status, err := s.masterStatus(ctx, "SHOW MASTER STATUS")
+	if err != nil {
+		// renamed in 8.4
+		status, err = s.masterStatus(ctx, "SHOW BINARY LOG STATUS")
+	}
+	if err != nil {
+		return err
+	}
+	if len(status) == 0 {
+		return ErrBinlogDisabled
+	}
+
+	position, _ := strconv.ParseUint(fmt.Sprint(status["Position"]), 10, 32)
+	pos.File, pos.Pos = fmt.Sprint(status["File"]), uint32(position)
+
+	return nil
+}
+
+func (s *ReplicaStreamer) masterStatus(ctx context.Context, query string) (map[string]interface{}, error) {
+	rows, err := s.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, Classify(err)
+	}
+
+	status, err := ScanMaps(rows)
+	if err != nil || len(status) == 0 {
+		return nil, err
+	}
+	return status[0], nil
+}
+
+func (s *ReplicaStreamer) registerSlave() []byte {
+	hostname, _ := os.Hostname()
+
+	b := []byte{comRegisterSlave}
+	b = appendUint32(b, s.serverId)
+	b = append(b, byte(len(hostname)))
+	b = append(b, hostname...)
+	b = append(b, byte(len(s.config.User)))
+	b = append(b, s.config.User...)
+	b = append(b, byte(len(s.config.Password)))
+	b = append(b, s.config.Password...)
+	b = append(b, 0, 0)       // port
+	b = appendUint32(b, 0)    // replication rank
+	return appendUint32(b, 0) // source id
+}
+
+func (s *ReplicaStreamer) binlogDump(pos BinlogPosition) []byte {
+	b := []byte{comBinlogDump}
+	b = appendUint32(b, pos.Pos)
+	b = append(b, 0, 0) // flags, block for new events
+	b = appendUint32(b, s.serverId)
+	return append(b, pos.File...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// command writes a command packet, each command restarting the sequence.
+func (s *ReplicaStreamer) command(payload []byte) error {
+	packet := make([]byte, 4+len(payload))
+	packet[0], packet[1], packet[2] = byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16)
+	copy(packet[4:], payload)
+
+	s.raw.SetWriteDeadline(time.Now().Add(binlogReadTimeout))
+	_, err := s.raw.Write(packet)
+	return err
+}
+
+// readPacket returns the next response, joining packets split at 16MB.
+func (s *ReplicaStreamer) readPacket() ([]byte, error) {
+	if s.reader == nil {
+		s.reader = bufio.NewReaderSize(s.raw, 1<<16)
+	}
+
+	var payload []byte
+	for {
+		s.raw.SetReadDeadline(time.Now().Add(binlogReadTimeout))
+
+		var header [4]byte
+		if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+			return nil, err
+		}
+
+		size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(s.reader, chunk); err != nil {
+			return nil, err
+		}
+		payload = append(payload, chunk...)
+
+		if size < maxPacketSize {
+			break
+		}
+	}
+
+	if len(payload) == 0 {
+		return nil, errBinlogShort
+	}
+
+	switch payload[0] {
+	case 0xff:
+		return nil, Classify(parseErrPacket(payload))
+	case 0xfe:
+		if len(payload) < 9 {
+			return nil, io.EOF
+		}
+	}
+
+	return payload, nil
+}
+
+func parseErrPacket(payload []byte) error {
+	if len(payload) < 3 {
+		return errBinlogShort
+	}
+
+	message := payload[3:]
+	if len(message) > 0 && message[0] == '#' && len(message) >= 6 {
+		// sql state
+		message = message[6:]
+	}
+
+	return &mysqlDriver.MySQLError{
+		Number:  binary.LittleEndian.Uint16(payload[1:3]),
+		Message: string(message),
+	}
+}
+
+func (s *ReplicaStreamer) ReadEvent(ctx context.Context) ([]byte, error) {
+	payload, err := s.readPacket()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// OK marker
+	return payload[1:], nil
+}
+
+func (s *ReplicaStreamer) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+
+	if s.raw != nil {
+		s.raw.Close()
+		s.raw = nil
+	}
+	s.reader = nil
+
+	if s.conn != nil {
+		// with no idle slot the driver closes it, on the socket closed above
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+
+	return err
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"sort"
+	"strings"
+)
+
+func sortedKeys(data map[string]interface{}) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// whereClause joins condition into "`k1`=? AND `k2`=?" with keys in a stable order.
+func whereClause(condition map[string]interface{}) (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+
+	for _, key := range sortedKeys(condition) {
+		if expr, ok := condition[key].(conditionExpr); ok {
+			part, exprArgs := expr.where(key)
+			parts = append(parts, part)
+			args = append(args, exprArgs...)
+			continue
+		}
+		parts = append(parts, "`"+key+"`=?")
+		args = append(args, condition[key])
+	}
+
+	return strings.Join(parts, " AND "), args
+}
+
+func buildInsert(table string, insertData map[string]interface{}) (string, []interface{}) {
+	var fields []string
+	var placeHolders []string
+	var args []interface{}
+
+	for _, k := range sortedKeys(insertData) {
+		fields = append(fields, "`"+k+"`")
+		placeHolders = append(placeHolders, "?")
+		args = append(args, insertData[k])
+	}
+
+	var sqlStr string = "INSERT INTO " + table + " (" + strings.Join(fields, ",") + ") VALUES (" + strings.Join(placeHolders, ",") + ")"
+
+	return sqlStr, args
+}
+
+func buildUpdate(table string, updateData map[string]interface{}, condition map[string]interface{}) (string, []interface{}) {
+	var fields []string
+	var args []interface{}
+
+	for _, k := range sortedKeys(updateData) {
+		if expr, ok := updateData[k].(updateExpr); ok {
+			field, exprArgs := expr.set(k)
+			fields = append(fields, field)
+			args = append(args, exprArgs...)
+			continue
+		}
+		fields = append(fields, "`"+k+"`=?")
+		args = append(args, updateData[k])
+	}
+
+	conditionStr, conditionArgs := whereClause(condition)
+	args = append(args, conditionArgs...)
+
+	var sqlStr string = "UPDATE " + table + " SET " + strings.Join(fields, ",") + " WHERE " + conditionStr
+
+	return sqlStr, args
+}
+
+func buildDelete(table string, condition map[string]interface{}) (string, []interface{}) {
+	conditionStr, args := whereClause(condition)
+
+	var sqlStr string = "DELETE FROM " + table + " WHERE " + conditionStr
+
+	return sqlStr, args
+}
+
+// buildSelect returns "SELECT fields FROM table", with a WHERE clause only when condition is not empty.
+func buildSelect(fields string, table string, condition map[string]interface{}) (string, []interface{}) {
+	var sqlStr string = "SELECT " + fields + " FROM " + table
+
+	conditionStr, args := whereClause(condition)
+	if conditionStr != "" {
+		sqlStr += " WHERE " + conditionStr
+	}
+
+	return sqlStr, args
+}
+
+// selectFields quotes columns for a SELECT list, "*" when empty.
+func selectFields(columns []string) string {
+	if len(columns) == 0 {
+		return "*"
+	}
+	return "`" + strings.Join(columns, "`,`") + "`"
+}
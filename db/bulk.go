@@ -0,0 +1,202 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var bulkCount int64
+
+// RowSource yields one row per call in the column order given to BulkLoad, and io.EOF after the last row.
+type RowSource interface {
+	Next() ([]interface{}, error)
+}
+
+type RowSourceFunc func() ([]interface{}, error)
+
+func (f RowSourceFunc) Next() ([]interface{}, error) {
+	return f()
+}
+
+type BulkResult struct {
+	Rows     int64
+	Warnings int64
+}
+
+/*
+ * BulkLoad
+ *
+ * Streams rows into table with LOAD DATA LOCAL INFILE, much faster than
+ * INSERT for large imports. Values are written in the default LOAD DATA text
+ * format: nil becomes NULL, driver.Valuer (e.g. Encrypted) is resolved first,
+ * and tabs, newlines and backslashes are escaped.
+ *
+ * The load runs in a tx, so nothing is imported when rows fails midway.
+ * The server must run with local_infile=ON. Warnings counts rows MySQL
+ * truncated or converted; check SHOW WARNINGS when it is not 0. Audit and
+ * column encryption registrations are not applied.
+ */
+func (db *Mysql) BulkLoad(ctx context.Context, table string, columns []string, rows RowSource) (BulkResult, error) {
+	pr, pw := io.Pipe()
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		w := bufio.NewWriter(pw)
+		for {
+			row, err := rows.Next()
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = writeBulkRow(w, row, len(columns))
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Flush())
+	}()
+
+	// BulkLoadReader closes pr on return, failing the writes still pending
+	result, err := db.BulkLoadReader(ctx, table, columns, pr)
+	<-finished
+
+	return result, err
+}
+
+/*
+ * BulkLoadReader loads data already in the LOAD DATA text format: tab
+ * separated fields, \n terminated lines, backslash escapes and \N for NULL.
+ * r is closed on return when it is an io.Closer.
+ */
+func (db *Mysql) BulkLoadReader(ctx context.Context, table string, columns []string, r io.Reader) (BulkResult, error) {
+	var result BulkResult
+
+	if closer, ok := r.(io.Closer); ok {
+		// on every return, a writer feeding r would block forever otherwise
+		defer closer.Close()
+	}
+
+	var name string = "bulk" + strconv.FormatInt(atomic.AddInt64(&bulkCount, 1), 10)
+	mysqlDriver.RegisterReaderHandler(name, func() io.Reader {
+		return r
+	})
+	defer mysqlDriver.DeregisterReaderHandler(name)
+
+	// warning count is per session, so load and read it on the same connection
+	p, done := db.acquire()
+	defer done()
+
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return result, Classify(err)
+	}
+	defer conn.Close()
+
+	// the driver ends the load like a complete one when r fails, only the rollback drops the rows sent until then
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return result, Classify(err)
+	}
+
+	var sqlStr string = "LOAD DATA LOCAL INFILE 'Reader::" + name + "' INTO TABLE " + table +
+		" CHARACTER SET utf8mb4 (`" + strings.Join(columns, "`,`") + "`)"
+
+	res, loadErr := tx.ExecContext(ctx, sqlStr)
+	if loadErr != nil {
+		tx.Rollback()
+		dwarflog.Error(loadErr, sqlStr)
+		return result, Classify(loadErr)
+	}
+
+	result.Rows, _ = res.RowsAffected()
+	// before COMMIT, which resets it
+	if err := tx.QueryRowContext(ctx, "SELECT @@warning_count").Scan(&result.Warnings); err != nil {
+		tx.Rollback()
+		return result, Classify(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, Classify(err)
+	}
+
+	db.invalidate(table)
+
+	return result, nil
+}
+
+func BulkLoad(ctx context.Context, table string, columns []string, rows RowSource) (BulkResult, error) {
+	return mysql.BulkLoad(ctx, table, columns, rows)
+}
+
+func BulkLoadReader(ctx context.Context, table string, columns []string, r io.Reader) (BulkResult, error) {
+	return mysql.BulkLoadReader(ctx, table, columns, r)
+}
+
+func writeBulkRow(w *bufio.Writer, row []interface{}, columnCount int) error {
+	if len(row) != columnCount {
+		return fmt.Errorf("bulk row has %d values, want %d", len(row), columnCount)
+	}
+
+	for i, v := range row {
+		if i > 0 {
+			w.WriteByte('\t')
+		}
+
+		field, err := bulkField(v)
+		if err != nil {
+			return err
+		}
+		w.WriteString(field)
+	}
+
+	return w.WriteByte('\n')
+}
+
+var bulkEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\t", "\\t",
+	"\n", "\\n",
+	"\r", "\\r",
+	"\x00", "\\0",
+)
+
+func bulkField(v interface{}) (string, error) {
+	if valuer, ok := v.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return "", err
+		}
+		v = value
+	}
+
+	switch t := v.(type) {
+	case nil:
+		return "\\N", nil
+	case string:
+		return bulkEscaper.Replace(t), nil
+	case []byte:
+		return bulkEscaper.Replace(string(t)), nil
+	case bool:
+		if t {
+			return "1", nil
+		}
+		return "0", nil
+	case time.Time:
+		return t.Format("2006-01-02 15:04:05.999999"), nil
+	}
+
+	return bulkEscaper.Replace(fmt.Sprint(v)), nil
+}
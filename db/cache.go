@@ -0,0 +1,248 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"sync"
+	"time"
+)
+
+const defaultCacheSize = 1024
+
+/*
+ * Cache stores encoded query results. Entries are tagged with the table they
+ * were read from so that writes to the table can drop them. MemoryCache is the
+ * in-process implementation, a shared store like redis can implement the same
+ * interface.
+ */
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(table string, key string, value []byte, ttl time.Duration)
+	InvalidateTable(table string)
+}
+
+type cacheEntry struct {
+	table    string
+	key      string
+	value    []byte
+	expireAt time.Time
+}
+
+// MemoryCache is a LRU cache with per-entry TTL.
+type MemoryCache struct {
+	mu     sync.Mutex
+	size   int
+	ll     *list.List
+	items  map[string]*list.Element
+	tables map[string]map[string]struct{}
+}
+
+func NewMemoryCache(size int) *MemoryCache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	return &MemoryCache{
+		size:   size,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		tables: make(map[string]map[string]struct{}),
+	}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *MemoryCache) Set(table string, key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+
+	entry := &cacheEntry{table: table, key: key, value: value}
+	if ttl > 0 {
+		entry.expireAt = time.Now().Add(ttl)
+	}
+
+	c.items[key] = c.ll.PushFront(entry)
+	if c.tables[table] == nil {
+		c.tables[table] = make(map[string]struct{})
+	}
+	c.tables[table][key] = struct{}{}
+
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *MemoryCache) InvalidateTable(table string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.tables[table] {
+		if el, ok := c.items[key]; ok {
+			c.remove(el)
+		}
+	}
+	delete(c.tables, table)
+}
+
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+// remove must be called with c.mu held.
+func (c *MemoryCache) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+
+	if keys, ok := c.tables[entry.table]; ok {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.tables, entry.table)
+		}
+	}
+}
+
+func cacheKey(query string, args []interface{}) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%#v", query, args)))
+	return "db:" + hex.EncodeToString(sum[:])
+}
+
+func (db *Mysql) SetCache(cache Cache) {
+	db.cache = cache
+}
+
+func SetCache(cache Cache) {
+	mysql.SetCache(cache)
+}
+
+// tableVersions counts the invalidations of each table, so a read that raced a write is not cached.
+type tableVersions struct {
+	mu     sync.Mutex
+	tables map[string]uint64
+}
+
+func (v *tableVersions) get(table string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.tables[table]
+}
+
+func (db *Mysql) invalidate(table string) {
+	if db == nil || db.cache == nil {
+		return
+	}
+
+	db.versions.mu.Lock()
+	defer db.versions.mu.Unlock()
+
+	db.versions.tables[table]++
+	db.cache.InvalidateTable(table)
+}
+
+// cacheSet stores value unless table was invalidated since version was read.
+func (db *Mysql) cacheSet(table string, version uint64, key string, value []byte, ttl time.Duration) {
+	db.versions.mu.Lock()
+	defer db.versions.mu.Unlock()
+
+	if db.versions.tables[table] == version {
+		db.cache.Set(table, key, value, ttl)
+	}
+}
+
+/*
+ * CachedQuery
+ *
+ * Read-through variant of Query: results are scanned into dest (see
+ * ScanStructs) and cached under the query and args for ttl. Add, Update and
+ * Delete on table drop the cached entries, raw Exec does not. A result read
+ * while such a write ran is returned but not cached.
+ */
+func (db *Mysql) CachedQuery(table string, ttl time.Duration, dest interface{}, query string, args ...interface{}) error {
+	if db.cache == nil {
+		return db.scanQuery(table, dest, query, args...)
+	}
+
+	var key string = cacheKey(query, args)
+	if value, ok := db.cache.Get(key); ok {
+		if err := json.Unmarshal(value, dest); err == nil {
+			return nil
+		}
+	}
+
+	var version uint64 = db.versions.get(table)
+	if err := db.scanQuery(table, dest, query, args...); err != nil {
+		return err
+	}
+
+	value, encodeErr := json.Marshal(dest)
+	if encodeErr != nil {
+		dwarflog.Error(encodeErr, query, args)
+		return nil
+	}
+	db.cacheSet(table, version, key, value, ttl)
+
+	return nil
+}
+
+func CachedQuery(table string, ttl time.Duration, dest interface{}, query string, args ...interface{}) error {
+	return mysql.CachedQuery(table, ttl, dest, query, args...)
+}
+
+func (db *Mysql) scanQuery(table string, dest interface{}, query string, args ...interface{}) error {
+	return db.scanQueryContext(context.Background(), table, dest, query, args...)
+}
+
+// scanQueryContext scans query on table ("" when unknown) into dest within the limits.
+func (db *Mysql) scanQueryContext(ctx context.Context, table string, dest interface{}, query string, args ...interface{}) (err error) {
+	db.explain(ctx, query, args)
+
+	st, err := db.guard(ctx, table, query)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		st.finish(err)
+	}()
+
+	p, done := db.acquire()
+	defer done()
+
+	rows, err := p.db.QueryContext(st.ctx, st.query, args...)
+	if err != nil {
+		dwarflog.Error(err, query, args)
+		return err
+	}
+	defer rows.Close()
+
+	return scanStructs(rows, dest, db.currentLimits().MaxRows, table, db.encrypted[table])
+}
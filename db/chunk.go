@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+)
+
+const (
+	defaultChunkKey  = "id"
+	defaultChunkSize = 500
+)
+
+var ErrChunkKey = errors.New("chunk key must be an integer column of the scanned struct")
+
+type ChunkConfig struct {
+	Table     string
+	Columns   []string               // empty means all columns
+	Key       string                 // integer primary key, default "id"
+	Condition map[string]interface{} // extra equality conditions
+	Size      int                    // rows per batch, default 500
+	Cursor    int64                  // resume after this key
+}
+
+/*
+ * Chunk
+ *
+ * Pages through cfg.Table with `WHERE key > ? ORDER BY key LIMIT n`, scanning
+ * each batch into dest (see ScanStructs) and calling handle with the key of
+ * the batch's last row. The connection is released between batches.
+ *
+ * It returns the cursor of the last handled batch, which can be saved and
+ * passed back as cfg.Cursor to resume. A batch whose handle fails is not
+ * counted, so resuming from the returned cursor retries it.
+ */
+func (db *Mysql) Chunk(ctx context.Context, cfg ChunkConfig, dest interface{}, handle func(cursor int64) error) (int64, error) {
+	var key string = cfg.Key
+	if key == "" {
+		key = defaultChunkKey
+	}
+
+	var size int = cfg.Size
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+
+	var fieldStr string = selectFields(cfg.Columns)
+
+	condition, err := db.prepareCondition(ctx, cfg.Table, cfg.Condition)
+	if err != nil {
+		return cfg.Cursor, err
+	}
+
+	conditionStr, conditionArgs := whereClause(condition)
+	if conditionStr != "" {
+		conditionStr += " AND "
+	}
+
+	var sqlStr string = "SELECT " + fieldStr + " FROM " + cfg.Table + " WHERE " + conditionStr +
+		"`" + key + "`>? ORDER BY `" + key + "` LIMIT ?"
+
+	var cursor int64 = cfg.Cursor
+	for {
+		if err := ctx.Err(); err != nil {
+			return cursor, err
+		}
+
+		args := append(append([]interface{}{}, conditionArgs...), cursor, size)
+		if err := db.scanQueryContext(ctx, cfg.Table, dest, sqlStr, args...); err != nil {
+			return cursor, err
+		}
+
+		batch := reflect.ValueOf(dest).Elem()
+		if batch.Len() == 0 {
+			return cursor, nil
+		}
+
+		last, keyErr := chunkCursor(batch.Index(batch.Len()-1), key)
+		if keyErr != nil {
+			return cursor, keyErr
+		}
+
+		if err := handle(last); err != nil {
+			return cursor, err
+		}
+		cursor = last
+
+		if batch.Len() < size {
+			return cursor, nil
+		}
+	}
+}
+
+func Chunk(ctx context.Context, cfg ChunkConfig, dest interface{}, handle func(cursor int64) error) (int64, error) {
+	return mysql.Chunk(ctx, cfg, dest, handle)
+}
+
+func chunkCursor(row reflect.Value, key string) (int64, error) {
+	field, ok := structColumn(row, key)
+	if !ok {
+		return 0, ErrChunkKey
+	}
+
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return field.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(field.Uint()), nil
+	}
+
+	return 0, ErrChunkKey
+}
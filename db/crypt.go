@@ -0,0 +1,397 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+ * cipher text layouts:
+ *   ENC1$<key id>$<base64(nonce|sealed)>, additional data <key id>
+ *   ENC2$<key id>$<table>.<column>$<base64(nonce|sealed)>, additional data <key id>|<table>.<column>
+ */
+const (
+	cipherPrefix      = "ENC1$"
+	boundCipherPrefix = "ENC2$"
+)
+
+var (
+	ErrNoKeyProvider      = errors.New("no key provider")
+	ErrUnknownKey         = errors.New("unknown encryption key")
+	ErrCipherText         = errors.New("malformed cipher text")
+	ErrCipherColumn       = errors.New("cipher text sealed for another column")
+	ErrEncryptedCondition = errors.New("encrypted column without blind index cannot be used in condition")
+	keyProvider           KeyProvider
+)
+
+/*
+ * KeyProvider
+ *
+ * CurrentKey encrypts new values, Key finds the key of older values by id so
+ * keys can be rotated without re-encrypting. Keys are 16, 24 or 32 bytes for
+ * AES-128/192/256. IndexKey feeds the blind index HMAC and must not rotate,
+ * or existing indexes stop matching.
+ */
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+	IndexKey() ([]byte, error)
+}
+
+type StaticKeyProvider struct {
+	current  string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+func NewStaticKeyProvider(current string, keys map[string][]byte, indexKey []byte) *StaticKeyProvider {
+	return &StaticKeyProvider{
+		current:  current,
+		keys:     keys,
+		indexKey: indexKey,
+	}
+}
+
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.current)
+	return p.current, key, err
+}
+
+func (p *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (p *StaticKeyProvider) IndexKey() ([]byte, error) {
+	return p.indexKey, nil
+}
+
+func SetKeyProvider(provider KeyProvider) {
+	keyProvider = provider
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals plain with AES-GCM under the current key.
+func Encrypt(plain string) (string, error) {
+	id, sealed, err := seal(plain, "")
+	if err != nil {
+		return "", err
+	}
+
+	return cipherPrefix + id + "$" + sealed, nil
+}
+
+/*
+ * EncryptFor is Encrypt bound to table.column: DecryptFor rejects the cipher
+ * text copied to another column or table. EncryptColumn writes these.
+ */
+func EncryptFor(table string, column string, plain string) (string, error) {
+	var bound string = table + "." + column
+	id, sealed, err := seal(plain, bound)
+	if err != nil {
+		return "", err
+	}
+
+	return boundCipherPrefix + id + "$" + bound + "$" + sealed, nil
+}
+
+// seal returns the current key id and base64(nonce|sealed), bound is added to the additional data.
+func seal(plain string, bound string) (string, string, error) {
+	if keyProvider == nil {
+		return "", "", ErrNoKeyProvider
+	}
+
+	id, key, err := keyProvider.CurrentKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), additionalData(id, bound))
+
+	return id, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func additionalData(id string, bound string) []byte {
+	if bound == "" {
+		return []byte(id)
+	}
+	return []byte(id + "|" + bound)
+}
+
+// Decrypt opens a value made by Encrypt or EncryptFor. Values without a
+// cipher prefix are returned as is, so columns can be migrated row by row.
+func Decrypt(cipherText string) (string, error) {
+	return open(cipherText, "")
+}
+
+/*
+ * DecryptFor is Decrypt for a value read from table.column, failing with
+ * ErrCipherColumn when it was sealed by EncryptFor for another one. Values
+ * of Encrypt, bound to no column, are still opened.
+ */
+func DecryptFor(table string, column string, cipherText string) (string, error) {
+	return open(cipherText, table+"."+column)
+}
+
+// open checks the column of a bound cipher text against want, unless want is empty.
+func open(cipherText string, want string) (string, error) {
+	var text, bound string
+	switch {
+	case strings.HasPrefix(cipherText, cipherPrefix):
+		text = strings.TrimPrefix(cipherText, cipherPrefix)
+	case strings.HasPrefix(cipherText, boundCipherPrefix):
+		text = strings.TrimPrefix(cipherText, boundCipherPrefix)
+	default:
+		return cipherText, nil
+	}
+	if keyProvider == nil {
+		return "", ErrNoKeyProvider
+	}
+
+	parts := strings.SplitN(text, "$", 2)
+	if len(parts) != 2 {
+		return "", ErrCipherText
+	}
+	id, text := parts[0], parts[1]
+
+	if strings.HasPrefix(cipherText, boundCipherPrefix) {
+		i := strings.LastIndex(text, "$")
+		if i < 0 {
+			return "", ErrCipherText
+		}
+		bound, text = text[:i], text[i+1:]
+		if want != "" && bound != want {
+			return "", ErrCipherColumn
+		}
+	}
+
+	key, err := keyProvider.Key(id)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return "", ErrCipherText
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", ErrCipherText
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData(id, bound))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// BlindIndex is a keyed hash of plain, stored next to an encrypted column for equality lookups.
+func BlindIndex(plain string) (string, error) {
+	if keyProvider == nil {
+		return "", ErrNoKeyProvider
+	}
+
+	key, err := keyProvider.IndexKey()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(plain))
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+/*
+ * Encrypted is a string encrypted on write and decrypted on scan. Use it as
+ * the field type of encrypted columns in scanned structs.
+ */
+type Encrypted string
+
+func (e Encrypted) Value() (driver.Value, error) {
+	return Encrypt(string(e))
+}
+
+// String keeps the plain text out of logs.
+func (e Encrypted) String() string {
+	return "******"
+}
+
+func (e *Encrypted) Scan(src interface{}) error {
+	return e.scan(src, "", "")
+}
+
+// scan decrypts src read from table.column, with DecryptFor when table is set.
+func (e *Encrypted) scan(src interface{}, table string, column string) error {
+	var text string
+	switch v := src.(type) {
+	case nil:
+		*e = ""
+		return nil
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return fmt.Errorf("cannot scan %T into Encrypted", src)
+	}
+
+	var plain string
+	var err error
+	if table == "" {
+		plain, err = Decrypt(text)
+	} else {
+		plain, err = DecryptFor(table, column, text)
+	}
+	if err != nil {
+		return err
+	}
+
+	*e = Encrypted(plain)
+	return nil
+}
+
+// columnScanner scans an Encrypted field of an encrypted column, see scanStructs.
+type columnScanner struct {
+	field  *Encrypted
+	table  string
+	column string
+}
+
+func (s columnScanner) Scan(src interface{}) error {
+	return s.field.scan(src, s.table, s.column)
+}
+
+/*
+ * EncryptColumn
+ *
+ * Makes Add and Update encrypt column of table with EncryptFor, and the
+ * select helpers of db decrypt it into Encrypted fields with DecryptFor. When
+ * blindIndex names a column, it is filled with BlindIndex of the value (NULL
+ * for NULL), and conditions on column are rewritten to look up the blind
+ * index instead.
+ */
+func (db *Mysql) EncryptColumn(table string, column string, blindIndex string) {
+	if db.encrypted == nil {
+		db.encrypted = make(map[string]map[string]string)
+	}
+	if db.encrypted[table] == nil {
+		db.encrypted[table] = make(map[string]string)
+	}
+	db.encrypted[table][column] = blindIndex
+}
+
+func EncryptColumn(table string, column string, blindIndex string) {
+	mysql.EncryptColumn(table, column, blindIndex)
+}
+
+func plainText(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return string(t)
+	case Encrypted:
+		return string(t)
+	}
+	return fmt.Sprint(v)
+}
+
+// sealWrite returns copies of data and condition with the encrypted columns of table sealed.
+func (db *Mysql) sealWrite(table string, data map[string]interface{}, condition map[string]interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	if db == nil || db.encrypted[table] == nil {
+		return data, condition, nil
+	}
+	columns := db.encrypted[table]
+
+	var sealedData map[string]interface{}
+	if data != nil {
+		sealedData = make(map[string]interface{}, len(data))
+		for k, v := range data {
+			sealedData[k] = v
+		}
+	}
+	var sealedCondition map[string]interface{}
+	if condition != nil {
+		sealedCondition = make(map[string]interface{}, len(condition))
+		for k, v := range condition {
+			sealedCondition[k] = v
+		}
+	}
+
+	for column, blindIndex := range columns {
+		if v, ok := data[column]; ok && v == nil {
+			// a NULL value leaves nothing for the old index to find
+			if blindIndex != "" {
+				sealedData[blindIndex] = nil
+			}
+		} else if ok {
+			plain := plainText(v)
+			// sealed here rather than by Encrypted.Value, so the audit sees the stored cipher text
+			sealed, err := EncryptFor(table, column, plain)
+			if err != nil {
+				return nil, nil, err
+			}
+			sealedData[column] = sealed
+
+			if blindIndex != "" {
+				index, err := BlindIndex(plain)
+				if err != nil {
+					return nil, nil, err
+				}
+				sealedData[blindIndex] = index
+			}
+		}
+
+		if v, ok := condition[column]; ok {
+			if blindIndex == "" {
+				return nil, nil, ErrEncryptedCondition
+			}
+
+			index, err := BlindIndex(plainText(v))
+			if err != nil {
+				return nil, nil, err
+			}
+			delete(sealedCondition, column)
+			sealedCondition[blindIndex] = index
+		}
+	}
+
+	return sealedData, sealedCondition, nil
+}
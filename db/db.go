@@ -1,13 +1,12 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"github.com/MangoMilk/go-lib/dwarflog"
 	_ "github.com/go-sql-driver/mysql"
-	"strings"
-	"time"
+	"sync"
 )
 
 type MysqlMode string
@@ -24,10 +23,32 @@ type MysqlConfig struct {
 	Password string    `yaml:"Password"`
 	Database string    `yaml:"Database"`
 	Mode     MysqlMode `yaml:"Mode"`
+
+	// prepared statement cache size, 0 means default, negative disables it
+	StmtCacheSize int `yaml:"StmtCacheSize"`
+
+	// development only, see SetExplain
+	Explain bool `yaml:"Explain"`
 }
 
 type Mysql struct {
-	Instance *sql.DB
+	Instance *sql.DB // replaced by Reload, read it through DB() then
+	mu       *sync.RWMutex
+	pool     *pool
+	cache    Cache
+	versions *tableVersions // bumped by invalidate, see CachedQuery
+	tracer   Tracer
+	audits   map[string]string // table to primary key
+	tenants  map[string]string // table to tenant column
+
+	// table to encrypted column to blind index column
+	encrypted map[string]map[string]string
+
+	limits  Limits
+	slots   map[string]chan struct{} // table to concurrency slots
+	breaker *breaker
+
+	explainer *explainer
 }
 
 var (
@@ -47,67 +68,146 @@ func Setup(configs []MysqlConfig) *Mysql {
 }
 
 func NewMysql(config MysqlConfig) *Mysql {
-	// gen config
-	var dsn string = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4", config.User, config.Password, config.Host, config.Port, config.Database)
-
-	// check config
-	db, err := sql.Open("mysql", dsn)
+	p, err := newPool(config)
 	if err != nil {
 		// log.Println("dsn: " + dsn)
 		panic("连接配置错误: " + err.Error())
 	}
 
-	// set conn config
-	db.SetConnMaxLifetime(time.Minute * 3) // set client max life time less than mysql param "wait_timeout"
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
+	db := newMysql(p)
+	db.SetExplain(config.Explain)
 
+	return db
+}
+
+func newMysql(p *pool) *Mysql {
 	return &Mysql{
-		Instance: db,
+		Instance: p.db,
+		mu:       new(sync.RWMutex),
+		pool:     p,
+		versions: &tableVersions{tables: make(map[string]uint64)},
 	}
 }
 
 func (db Mysql) Open() {
-	err := db.Instance.Ping()
+	err := db.DB().Ping()
 	if err != nil {
 		panic(err)
 	}
 }
 
 func (db Mysql) Close() {
-	err := db.Instance.Close()
+	db.mu.RLock()
+	p := db.pool
+	db.mu.RUnlock()
+
+	err := p.close()
 	if err != nil {
 		panic(err)
 	}
 }
 
-func Add(table string, insertData map[string]interface{}) (int64, error) {
+// exec runs query through the prepared statement cache when it is enabled.
+func (db *Mysql) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	traceStatement(ctx, query)
+
+	p, done := db.acquire()
+	defer done()
+
+	if p.stmts == nil {
+		return p.db.ExecContext(ctx, query, args...)
+	}
+
+	stmt, release, err := p.stmts.get(ctx, p.db, query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return stmt.ExecContext(ctx, args...)
+}
+
+/*
+ * SetStmtCacheSize changes the prepared statement cache limit, evicting the
+ * least recently used statements. As MysqlConfig.StmtCacheSize, 0 means the
+ * default and a negative size disables the cache.
+ */
+func (db *Mysql) SetStmtCacheSize(size int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if size < 0 {
+		if db.pool.stmts != nil {
+			db.pool.stmts.close()
+			db.pool.stmts = nil
+		}
+		return
+	}
+	if size == 0 {
+		size = defaultStmtCacheSize
+	}
 
-	var fieldStr string = "("
-	var placeHolderStr string = "("
-	var args []interface{}
+	if db.pool.stmts == nil {
+		db.pool.stmts = newStmtCache(size)
+		return
+	}
+	db.pool.stmts.resize(size)
+}
 
-	for k, v := range insertData {
-		fieldStr += "`" + k + "`,"
-		placeHolderStr += "?,"
-		args = append(args, v)
+func (db *Mysql) StmtStats() StmtStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.pool.stmts == nil {
+		return StmtStats{}
 	}
+	return db.pool.stmts.stats()
+}
 
-	fieldStr = strings.Trim(fieldStr, ",") + ")"
-	placeHolderStr = strings.Trim(placeHolderStr, ",") + ")"
+func (db *Mysql) Add(table string, insertData map[string]interface{}) (int64, error) {
+	return db.AddContext(context.Background(), table, insertData)
+}
 
-	var sqlStr string = "INSERT INTO " + table + " " + fieldStr + " VALUES " + placeHolderStr
+func (db *Mysql) AddContext(ctx context.Context, table string, insertData map[string]interface{}) (int64, error) {
+	ctx, span := db.startSpan(ctx, "db.Add", table)
+	n, err := db.add(ctx, table, insertData)
+	endSpan(span, n, err)
 
-	res, insertErr := mysql.Instance.Exec(sqlStr, args...)
+	return n, err
+}
 
-	// panic("sql:" + sqlStr)
-	// panic(args)
+func (db *Mysql) add(ctx context.Context, table string, insertData map[string]interface{}) (int64, error) {
+
+	if db.audited(table) {
+		var lastInsertId int64
+		err := db.inTx(ctx, func(tx *TxInstance) (err error) {
+			lastInsertId, err = tx.AddContext(ctx, table, insertData)
+			return
+		})
+		return lastInsertId, err
+	}
+
+	insertData, prepareErr := db.prepareInsert(ctx, table, insertData)
+	if prepareErr != nil {
+		return 0, prepareErr
+	}
+
+	sqlStr, args := buildInsert(table, insertData)
+
+	st, guardErr := db.guard(ctx, table, sqlStr)
+	if guardErr != nil {
+		return 0, guardErr
+	}
+	res, insertErr := db.exec(st.ctx, st.query, args...)
+	st.finish(insertErr)
 
 	if insertErr != nil {
 		dwarflog.Error(insertErr, sqlStr, args)
-		return 0, insertErr
+		return 0, Classify(insertErr)
 	}
 
+	db.invalidate(table)
+
 	//插入数据的主键id
 	lastInsertId, _ := res.LastInsertId()
 
@@ -117,43 +217,50 @@ func Add(table string, insertData map[string]interface{}) (int64, error) {
 /*
  * Update
  */
-func Update(table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
-
-	var fieldStr string = ""
-	var conditionStr string = ""
-	var args []interface{}
+func (db *Mysql) Update(table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
+	return db.UpdateContext(context.Background(), table, updateData, condition)
+}
 
-	// update data
-	for k, v := range updateData {
-		fieldStr += "`" + k + "`=?,"
-		args = append(args, v)
-	}
+func (db *Mysql) UpdateContext(ctx context.Context, table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
+	ctx, span := db.startSpan(ctx, "db.Update", table)
+	n, err := db.update(ctx, table, updateData, condition)
+	endSpan(span, n, err)
 
-	fieldStr = strings.Trim(fieldStr, ",")
+	return n, err
+}
 
-	// condition
-	var conditionCount int = len(condition)
-	var c int = 1
-	for key, val := range condition {
-		conditionStr += "`" + key + "`=?"
-		args = append(args, val)
+func (db *Mysql) update(ctx context.Context, table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
 
-		if c != conditionCount {
-			conditionStr += " AND "
-		}
+	if db.audited(table) {
+		var affectedRows int64
+		err := db.inTx(ctx, func(tx *TxInstance) (err error) {
+			affectedRows, err = tx.UpdateContext(ctx, table, updateData, condition)
+			return
+		})
+		return affectedRows, err
+	}
 
-		c++
+	updateData, condition, prepareErr := db.prepareUpdate(ctx, table, updateData, condition)
+	if prepareErr != nil {
+		return 0, prepareErr
 	}
 
-	var sqlStr string = "UPDATE " + table + " SET " + fieldStr + " WHERE " + conditionStr
+	sqlStr, args := buildUpdate(table, updateData, condition)
 
-	res, updateErr := mysql.Instance.Exec(sqlStr, args...)
+	st, guardErr := db.guard(ctx, table, sqlStr)
+	if guardErr != nil {
+		return 0, guardErr
+	}
+	res, updateErr := db.exec(st.ctx, st.query, args...)
+	st.finish(updateErr)
 
 	if updateErr != nil {
 		dwarflog.Error(updateErr, sqlStr, args)
-		return 0, updateErr
+		return 0, Classify(updateErr)
 	}
 
+	db.invalidate(table)
+
 	affectedRows, _ := res.RowsAffected()
 
 	return affectedRows, nil
@@ -163,47 +270,189 @@ func Update(table string, updateData map[string]interface{}, condition map[strin
 /*
  * Delete
  */
-func Delete(table string, condition map[string]interface{}) (int64, error) {
+func (db *Mysql) Delete(table string, condition map[string]interface{}) (int64, error) {
+	return db.DeleteContext(context.Background(), table, condition)
+}
 
-	var conditionStr string = ""
-	var args []interface{}
+func (db *Mysql) DeleteContext(ctx context.Context, table string, condition map[string]interface{}) (int64, error) {
+	ctx, span := db.startSpan(ctx, "db.Delete", table)
+	n, err := db.delete(ctx, table, condition)
+	endSpan(span, n, err)
 
-	// condition
-	var conditionCount int = len(condition)
-	var c int = 1
-	for key, val := range condition {
-		conditionStr += "`" + key + "`=?"
-		args = append(args, val)
+	return n, err
+}
 
-		if c != conditionCount {
-			conditionStr += " AND "
-		}
+func (db *Mysql) delete(ctx context.Context, table string, condition map[string]interface{}) (int64, error) {
 
-		c++
+	if db.audited(table) {
+		var affectedRows int64
+		err := db.inTx(ctx, func(tx *TxInstance) (err error) {
+			affectedRows, err = tx.DeleteContext(ctx, table, condition)
+			return
+		})
+		return affectedRows, err
 	}
 
-	var sqlStr string = "DELETE FROM " + table + " WHERE " + conditionStr
+	condition, prepareErr := db.prepareCondition(ctx, table, condition)
+	if prepareErr != nil {
+		return 0, prepareErr
+	}
 
-	res, updateErr := mysql.Instance.Exec(sqlStr, args...)
+	sqlStr, args := buildDelete(table, condition)
+
+	st, guardErr := db.guard(ctx, table, sqlStr)
+	if guardErr != nil {
+		return 0, guardErr
+	}
+	res, updateErr := db.exec(st.ctx, st.query, args...)
+	st.finish(updateErr)
 
 	if updateErr != nil {
 		dwarflog.Error(updateErr, sqlStr, args)
-		return 0, updateErr
+		return 0, Classify(updateErr)
 	}
 
+	db.invalidate(table)
+
 	affectedRows, _ := res.RowsAffected()
 
 	return affectedRows, nil
 }
 
+func (db *Mysql) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+func (db *Mysql) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *Mysql) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *Mysql) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := db.startSpan(ctx, "db.QueryRow", "")
+	span.SetAttribute(AttrStatement, query)
+	defer span.End(nil)
+
+	db.explain(ctx, query, args)
+
+	st, err := db.guard(ctx, "", query)
+	if err != nil {
+		// a Row carrying err, so Scan returns it
+		return db.DB().QueryRowContext(errorContext(err), query, args...)
+	}
+
+	p, done := db.acquire()
+	defer done()
+
+	row := p.db.QueryRowContext(st.ctx, st.query, args...)
+	st.release(row.Err())
+
+	return row
+}
+
+func (db *Mysql) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := db.startSpan(ctx, "db.Query", "")
+	span.SetAttribute(AttrStatement, query)
+
+	db.explain(ctx, query, args)
+
+	st, err := db.guard(ctx, "", query)
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+
+	p, done := db.acquire()
+	defer done()
+
+	rows, err := p.db.QueryContext(st.ctx, st.query, args...)
+	err = Classify(err)
+	st.release(err)
+	span.End(err)
+
+	return rows, err
+}
+
+func (db *Mysql) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := db.startSpan(ctx, "db.Exec", "")
+	span.SetAttribute(AttrStatement, query)
+
+	st, err := db.guard(ctx, "", query)
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+
+	p, done := db.acquire()
+	defer done()
+
+	res, err := p.db.ExecContext(st.ctx, st.query, args...)
+	err = Classify(err)
+	st.finish(err)
+
+	var affectedRows int64
+	if err == nil {
+		affectedRows, _ = res.RowsAffected()
+	}
+	endSpan(span, affectedRows, err)
+
+	return res, err
+}
+
+func Add(table string, insertData map[string]interface{}) (int64, error) {
+	return mysql.Add(table, insertData)
+}
+
+func Update(table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
+	return mysql.Update(table, updateData, condition)
+}
+
+func Delete(table string, condition map[string]interface{}) (int64, error) {
+	return mysql.Delete(table, condition)
+}
+
+func AddContext(ctx context.Context, table string, insertData map[string]interface{}) (int64, error) {
+	return mysql.AddContext(ctx, table, insertData)
+}
+
+func UpdateContext(ctx context.Context, table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
+	return mysql.UpdateContext(ctx, table, updateData, condition)
+}
+
+func DeleteContext(ctx context.Context, table string, condition map[string]interface{}) (int64, error) {
+	return mysql.DeleteContext(ctx, table, condition)
+}
+
 func QueryRow(query string, args ...interface{}) *sql.Row {
-	return mysql.Instance.QueryRow(query, args...)
+	return mysql.QueryRow(query, args...)
 }
 
 func Query(query string, args ...interface{}) (*sql.Rows, error) {
-	return mysql.Instance.Query(query, args...)
+	return mysql.Query(query, args...)
 }
 
 func Exec(query string, args ...interface{}) (sql.Result, error) {
-	return mysql.Instance.Exec(query, args...)
+	return mysql.Exec(query, args...)
+}
+
+func QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return mysql.QueryRowContext(ctx, query, args...)
+}
+
+func QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return mysql.QueryContext(ctx, query, args...)
+}
+
+func ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return mysql.ExecContext(ctx, query, args...)
+}
+
+// Swap replaces the instance used by the package level helpers, e.g. with Fake.Mysql() in tests, and returns the previous one.
+func Swap(db *Mysql) *Mysql {
+	old := mysql
+	mysql = db
+	return old
 }
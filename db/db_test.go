@@ -0,0 +1,1473 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestMain(m *testing.M) {
+	// failed statements are logged
+	dwarflog.Setup(&dwarflog.Config{
+		Format:     dwarflog.JsonFormat,
+		Path:       "./log",
+		FilePrefix: "db",
+	})
+	os.Exit(m.Run())
+}
+
+func TestBuildStableOrder(t *testing.T) {
+	data := map[string]interface{}{"name": "a", "age": 1, "city": "sz"}
+	condition := map[string]interface{}{"uid": 2, "id": 1}
+
+	sqlStr, args := buildInsert("user", data)
+	if sqlStr != "INSERT INTO user (`age`,`city`,`name`) VALUES (?,?,?)" {
+		t.Fatal(sqlStr)
+	}
+	if !reflect.DeepEqual(args, []interface{}{1, "sz", "a"}) {
+		t.Fatal(args)
+	}
+
+	sqlStr, args = buildUpdate("user", data, condition)
+	if sqlStr != "UPDATE user SET `age`=?,`city`=?,`name`=? WHERE `id`=? AND `uid`=?" {
+		t.Fatal(sqlStr)
+	}
+	if !reflect.DeepEqual(args, []interface{}{1, "sz", "a", 1, 2}) {
+		t.Fatal(args)
+	}
+
+	sqlStr, args = buildDelete("user", condition)
+	if sqlStr != "DELETE FROM user WHERE `id`=? AND `uid`=?" {
+		t.Fatal(sqlStr)
+	}
+	if !reflect.DeepEqual(args, []interface{}{1, 2}) {
+		t.Fatal(args)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache(2)
+
+	c.Set("user", "a", []byte("1"), 0)
+	c.Set("user", "b", []byte("2"), 0)
+	c.Get("a")
+	c.Set("order", "c", []byte("3"), 0)
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("least recently used entry should be evicted")
+	}
+
+	c.InvalidateTable("user")
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("table entries should be invalidated")
+	}
+	if v, ok := c.Get("c"); !ok || string(v) != "3" {
+		t.Fatal("other tables should be kept")
+	}
+
+	c.Set("order", "d", []byte("4"), time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+	if _, ok := c.Get("d"); ok {
+		t.Fatal("expired entry should be missed")
+	}
+}
+
+// hookedId runs onScan when scanned, to interleave statements with a read.
+type hookedId int64
+
+var onScan func()
+
+func (h *hookedId) Scan(src interface{}) error {
+	if hook := onScan; hook != nil {
+		onScan = nil
+		hook()
+	}
+	*h = hookedId(src.(int64))
+	return nil
+}
+
+func TestCachedQuery(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	db.SetCache(NewMemoryCache(0))
+
+	fake.On("SELECT").ReturnRows([]string{"id"}, []interface{}{int64(1)})
+	type config struct {
+		Id hookedId `db:"id"`
+	}
+
+	// a write between the scan and the Set: the old rows must not be cached
+	onScan = func() {
+		db.Update("config", map[string]interface{}{"v": 2}, map[string]interface{}{"id": 1})
+	}
+	var configs []config
+	if err := db.CachedQuery("config", 0, &configs, "SELECT id FROM config"); err != nil || len(configs) != 1 {
+		t.Fatal(configs, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := db.CachedQuery("config", 0, &configs, "SELECT id FROM config"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var selects int
+	for _, record := range fake.Records() {
+		if strings.HasPrefix(record.Query, "SELECT") {
+			selects++
+		}
+	}
+	if selects != 2 {
+		t.Fatal(fake.Records())
+	}
+}
+
+func TestStmtCache(t *testing.T) {
+	fake := NewFake()
+	sqlDB := fake.Mysql().DB()
+	c := newStmtCache(2)
+	ctx := context.Background()
+
+	first, releaseFirst, err := c.get(ctx, sqlDB, "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, release, _ := c.get(ctx, sqlDB, "SELECT 2")
+	release()
+	_, release, _ = c.get(ctx, sqlDB, "SELECT 1")
+	release()
+
+	// SELECT 2 is the least recently used, and closed at once as nobody holds it
+	_, release, _ = c.get(ctx, sqlDB, "SELECT 3")
+	release()
+	if stats := c.stats(); stats != (StmtStats{Size: 2, Hits: 1, Misses: 3, Evictions: 1}) {
+		t.Fatal(stats)
+	}
+	if _, err := second.Exec(); err == nil {
+		t.Fatal("evicted statement still open")
+	}
+
+	// SELECT 1 is evicted while borrowed, it is closed on release
+	c.resize(1)
+	if _, err := first.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	releaseFirst()
+	if _, err := first.Exec(); err == nil {
+		t.Fatal("released statement still open")
+	}
+
+	c.get(ctx, sqlDB, "SELECT 2")
+	if stats := c.stats(); stats != (StmtStats{Size: 1, Hits: 1, Misses: 4, Evictions: 3}) {
+		t.Fatal(stats)
+	}
+
+	// same meaning as MysqlConfig.StmtCacheSize
+	db := fake.Mysql()
+	db.SetStmtCacheSize(-1)
+	db.SetStmtCacheSize(-1)
+	if _, err := db.Exec("SELECT 1"); err != nil || db.StmtStats() != (StmtStats{}) {
+		t.Fatal(db.StmtStats(), err)
+	}
+	db.SetStmtCacheSize(0)
+	db.Add("user", map[string]interface{}{"name": "a"})
+	db.Add("user", map[string]interface{}{"name": "a"})
+	if stats := db.StmtStats(); stats != (StmtStats{Size: 1, Hits: 1, Misses: 1}) {
+		t.Fatal(stats)
+	}
+
+	// a tx holding the only connection does not wait for another one to prepare
+	db = fake.Mysql()
+	db.DB().SetMaxOpenConns(1)
+	added := make(chan error)
+	go func() {
+		tx, err := db.BeginTx()
+		if err == nil {
+			_, err = tx.Add("user", map[string]interface{}{"name": "a"})
+			tx.Commit()
+		}
+		added <- err
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tx waits for a second connection")
+	}
+}
+
+func TestFake(t *testing.T) {
+	fake := NewFake()
+	old := Swap(fake.Mysql())
+	defer Swap(old)
+
+	id, err := Add("user", map[string]interface{}{"name": "a"})
+	if err != nil || id != 1 {
+		t.Fatal(id, err)
+	}
+
+	tx, _ := BeginTx()
+	tx.Update("user", map[string]interface{}{"name": "b"}, map[string]interface{}{"id": 1})
+	tx.Rollback()
+
+	executed := fake.Executed()
+	if len(executed) != 1 || executed[0].Query != "INSERT INTO user (`name`) VALUES (?)" {
+		t.Fatal(executed)
+	}
+	if records := fake.Records(); len(records) != 2 || records[1].TxState != FakeRolledBack {
+		t.Fatal(records)
+	}
+
+	dupErr := errors.New("duplicate")
+	fake.On("INSERT INTO user").ReturnError(dupErr)
+	if _, err := Add("user", map[string]interface{}{"name": "a"}); err != dupErr {
+		t.Fatal(err)
+	}
+
+	type user struct {
+		Id   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+	fake.On("SELECT").ReturnRows([]string{"id", "name"}, []interface{}{int64(1), "a"}, []interface{}{int64(2), "b"})
+	rows, _ := Query("SELECT id, name FROM user")
+	defer rows.Close()
+
+	var users []user
+	if err := ScanStructs(rows, &users); err != nil || len(users) != 2 || users[1].Name != "b" {
+		t.Fatal(users, err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	err := Classify(&mysqlDriver.MySQLError{Number: 1062, Message: "Duplicate entry 'a@b.c' for key 'user.uk_email'"})
+	var e *MysqlError
+	if !errors.As(err, &e) || !IsDuplicate(err) || e.Key != "user.uk_email" || e.Value != "a@b.c" {
+		t.Fatal(err)
+	}
+
+	err = Classify(&mysqlDriver.MySQLError{Number: 1452, Message: "Cannot add or update a child row: a foreign key constraint fails (`shop`.`order`, CONSTRAINT `fk_order_user` FOREIGN KEY (`uid`) REFERENCES `user` (`id`))"})
+	if !errors.Is(err, ErrForeignKey) || !errors.As(err, &e) || e.Key != "fk_order_user" {
+		t.Fatal(err)
+	}
+
+	if !IsRetryable(&mysqlDriver.MySQLError{Number: 1213}) || IsConnLost(&mysqlDriver.MySQLError{Number: 1213}) {
+		t.Fatal("deadlock should be retryable")
+	}
+	if IsRetryable(mysqlDriver.ErrInvalidConn) || !IsConnLost(mysqlDriver.ErrInvalidConn) {
+		t.Fatal("lost connection has an unknown outcome")
+	}
+
+	plain := errors.New("plain")
+	if Classify(plain) != plain || IsRetryable(plain) {
+		t.Fatal("unknown errors should be kept as is")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	fake.On("SELECT COUNT(*) FROM user WHERE `status`=?").ReturnRows([]string{"n"}, []interface{}{int64(3)})
+	if n, err := db.Count("user", map[string]interface{}{"status": 1}); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+
+	if ok, err := db.Exists("user", map[string]interface{}{"id": 9}); err != nil || ok {
+		t.Fatal(ok, err)
+	}
+
+	fake.On("SUM(`amount`)").ReturnRows([]string{"s"}, []interface{}{nil})
+	if total, err := db.Sum("order", "amount", nil); err != nil || total != 0 {
+		t.Fatal(total, err)
+	}
+
+	fake.On("SUM(`price`)").ReturnRows([]string{"s"}, []interface{}{[]byte("12345678901234567.89")})
+	var exact sql.NullString
+	if err := db.SumInto("order", "price", nil, &exact); err != nil || exact.String != "12345678901234567.89" {
+		t.Fatal(exact, err)
+	}
+
+	fake.On("MAX(`id`)").ReturnRows([]string{"m"}, []interface{}{nil})
+	var max *int64
+	if err := db.Max("order", "id", nil, &max); err != nil || max != nil {
+		t.Fatal(max, err)
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	fake.On("SKIP LOCKED").ReturnRows([]string{"id", "topic", "payload", "attempts"},
+		[]interface{}{int64(1), "order.paid", []byte("{}"), int64(0)},
+		[]interface{}{int64(2), "order.paid", []byte("{}"), int64(0)},
+	)
+
+	var published []int64
+	relay := NewOutboxRelay(db, PublisherFunc(func(ctx context.Context, msg OutboxMessage) error {
+		if msg.Id == 2 {
+			return errors.New("broker down")
+		}
+		published = append(published, msg.Id)
+		return nil
+	}))
+
+	if n, err := relay.Poll(context.Background()); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if len(published) != 1 || published[0] != 1 {
+		t.Fatal(published)
+	}
+
+	executed := fake.Executed()
+	if len(executed) != 3 || executed[1].Args[0] != int64(OutboxDelivered) || executed[2].Args[0] != int64(1) {
+		t.Fatal(executed)
+	}
+
+	// a long error is cut by characters, the batch size and interval fall back to the defaults
+	fake.Reset()
+	fake.On("SKIP LOCKED").ReturnRows([]string{"id", "topic", "payload", "attempts"}, []interface{}{int64(3), "order.paid", []byte("{}"), int64(0)})
+	relay = NewOutboxRelay(db, PublisherFunc(func(ctx context.Context, msg OutboxMessage) error {
+		return errors.New(strings.Repeat("错", 1500))
+	}))
+	relay.BatchSize, relay.Interval = 0, 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := relay.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	executed = fake.Executed()
+	if len(executed) != 2 || executed[0].Args[1] != int64(defaultOutboxBatchSize) {
+		t.Fatal(executed)
+	}
+	if lastError := executed[1].Args[1].(string); !utf8.ValidString(lastError) || utf8.RuneCountInString(lastError) != maxOutboxError {
+		t.Fatal(len(lastError))
+	}
+}
+
+func TestAudit(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	db.Audit("user", "id")
+
+	fake.On("FOR UPDATE").ReturnRows([]string{"id", "name"}, []interface{}{int64(7), []byte("old")})
+	fake.On("WHERE `id` IN").ReturnRows([]string{"id", "name"}, []interface{}{int64(7), []byte("new")})
+
+	ctx := WithActor(context.Background(), "admin")
+	if _, err := db.UpdateContext(ctx, "user", map[string]interface{}{"name": "new"}, map[string]interface{}{"id": 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	executed := fake.Executed()
+	if len(executed) != 4 || executed[3].TxState != FakeCommitted {
+		t.Fatal(executed)
+	}
+	if reread := executed[2]; reread.Query != "SELECT * FROM user WHERE `id` IN (?)" || reread.Args[0] != int64(7) {
+		t.Fatal(reread)
+	}
+
+	audit := executed[3]
+	// columns are sorted: action, actor, after_data, before_data, pk, table_name
+	want := []interface{}{"update", "admin", `{"id":7,"name":"new"}`, `{"id":7,"name":"old"}`, "7", "user"}
+	if audit.Query != "INSERT INTO db_audit (`action`,`actor`,`after_data`,`before_data`,`pk`,`table_name`) VALUES (?,?,?,?,?,?)" || !reflect.DeepEqual(audit.Args, want) {
+		t.Fatal(audit)
+	}
+}
+
+func TestEncryptColumn(t *testing.T) {
+	keys := map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")}
+	SetKeyProvider(NewStaticKeyProvider("k1", keys, []byte("index-key")))
+	defer SetKeyProvider(nil)
+
+	fake := NewFake()
+	db := fake.Mysql()
+	db.EncryptColumn("user", "phone", "phone_bidx")
+
+	db.Add("user", map[string]interface{}{"phone": "13800000000"})
+	db.Update("user", map[string]interface{}{"name": "a"}, map[string]interface{}{"phone": "13800000000"})
+
+	executed := fake.Executed()
+	insert, update := executed[0], executed[1]
+	if insert.Query != "INSERT INTO user (`phone`,`phone_bidx`) VALUES (?,?)" || update.Query != "UPDATE user SET `name`=? WHERE `phone_bidx`=?" {
+		t.Fatal(insert.Query, update.Query)
+	}
+	if insert.Args[1] != update.Args[1] {
+		t.Fatal("blind index should match on lookup")
+	}
+
+	cipherText := insert.Args[0].(string)
+	if strings.Contains(cipherText, "13800000000") {
+		t.Fatal("value should be encrypted")
+	}
+
+	// rotate: new values use k2, old ones still decrypt with k1
+	keys["k2"] = []byte("fedcba9876543210fedcba9876543210")
+	SetKeyProvider(NewStaticKeyProvider("k2", keys, []byte("index-key")))
+
+	var phone Encrypted
+	if err := phone.Scan([]byte(cipherText)); err != nil || phone != "13800000000" {
+		t.Fatal(phone, err)
+	}
+	if rotated, _ := Encrypt("x"); !strings.HasPrefix(rotated, cipherPrefix+"k2$") {
+		t.Fatal(rotated)
+	}
+
+	if _, err := db.Delete("user", map[string]interface{}{"phone": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	db.EncryptColumn("user", "id_number", "")
+	if _, err := db.Delete("user", map[string]interface{}{"id_number": "1"}); err != ErrEncryptedCondition {
+		t.Fatal(err)
+	}
+
+	// NULL clears the blind index too
+	fake.Reset()
+	db.Update("user", map[string]interface{}{"phone": nil}, map[string]interface{}{"id": 1})
+	if update := fake.Executed()[0]; update.Query != "UPDATE user SET `phone`=?,`phone_bidx`=? WHERE `id`=?" || update.Args[0] != nil || update.Args[1] != nil {
+		t.Fatal(update)
+	}
+
+	// the cipher text is bound to user.phone, a copy to another column does not open
+	type user struct {
+		Phone    Encrypted `db:"phone"`
+		IdNumber Encrypted `db:"id_number"`
+	}
+	fake.On("SELECT").ReturnRows([]string{"phone"}, []interface{}{[]byte(cipherText)})
+	var users []user
+	if err := db.scanQuery("user", &users, "SELECT phone FROM user"); err != nil || users[0].Phone != "13800000000" {
+		t.Fatal(users, err)
+	}
+	fake.Reset()
+	fake.On("SELECT").ReturnRows([]string{"id_number"}, []interface{}{[]byte(cipherText)})
+	if err := db.scanQuery("user", &users, "SELECT id_number FROM user"); !errors.Is(err, ErrCipherColumn) {
+		t.Fatal(err)
+	}
+	if _, err := DecryptFor("order", "phone", cipherText); err != ErrCipherColumn {
+		t.Fatal(err)
+	}
+
+	// the column in the cipher text is authenticated
+	forged := strings.Replace(cipherText, "$user.phone$", "$user.id_number$", 1)
+	if _, err := DecryptFor("user", "id_number", forged); err == nil {
+		t.Fatal("forged column opened")
+	}
+}
+
+func TestAuditEncryptedInsert(t *testing.T) {
+	SetKeyProvider(NewStaticKeyProvider("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")}, []byte("index-key")))
+	defer SetKeyProvider(nil)
+
+	fake := NewFake()
+	db := fake.Mysql()
+	db.Audit("user", "id")
+	db.EncryptColumn("user", "phone", "")
+
+	fake.On("WHERE `id` IN").ReturnRows([]string{"id", "phone", "secret"}, []interface{}{int64(1), []byte("ENC2$phone"), []byte("ENC1$secret")})
+	if _, err := db.Add("user", map[string]interface{}{"phone": "13800000000", "secret": Encrypted("s3cret")}); err != nil {
+		t.Fatal(err)
+	}
+
+	executed := fake.Executed()
+	if len(executed) != 3 {
+		t.Fatal(executed)
+	}
+	reread, audit := executed[1], executed[2]
+	if reread.Args[0] != int64(1) {
+		t.Fatal(reread)
+	}
+
+	// columns are sorted: action, actor, after_data, ...
+	if after := audit.Args[2].(string); after != `{"id":1,"phone":"ENC2$phone","secret":"ENC1$secret"}` {
+		t.Fatal(after)
+	}
+}
+
+func TestAuditEncryptedUpdate(t *testing.T) {
+	SetKeyProvider(NewStaticKeyProvider("k1", map[string][]byte{"k1": []byte("0123456789abcdef0123456789abcdef")}, []byte("index-key")))
+	defer SetKeyProvider(nil)
+
+	fake := NewFake()
+	db := fake.Mysql()
+	db.Audit("user", "id")
+	db.EncryptColumn("user", "phone", "")
+
+	stored, _ := EncryptFor("user", "phone", "13800000000")
+	fake.On("FOR UPDATE").ReturnRows([]string{"id", "phone", "attrs"}, []interface{}{int64(7), []byte(stored), []byte(`{"color": "blue"}`)})
+	fake.On("WHERE `id` IN").ReturnRows([]string{"id", "phone", "attrs"}, []interface{}{int64(7), []byte("ENC2$new"), []byte(`{"color": "red"}`)})
+
+	// expressions and encrypted values are audited as stored, not as passed
+	if _, err := db.Update("user", map[string]interface{}{
+		"phone": "13900000000",
+		"attrs": JSONSet(map[string]interface{}{"$.color": "red"}),
+	}, map[string]interface{}{"id": 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	executed := fake.Executed()
+	audit := executed[3]
+	after, before := audit.Args[2].(string), audit.Args[3].(string)
+
+	if before != `{"attrs":"{\"color\": \"blue\"}","id":7,"phone":"`+stored+`"}` {
+		t.Fatal(before)
+	}
+	if after != `{"attrs":"{\"color\": \"red\"}","id":7,"phone":"ENC2$new"}` {
+		t.Fatal(after)
+	}
+	if update := executed[1]; !strings.HasPrefix(update.Args[2].(string), boundCipherPrefix+"k1$user.phone$") {
+		t.Fatal(update)
+	}
+}
+
+func TestBulkRow(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+
+	row := []interface{}{int64(1), "a\tb\nc\\", nil, true, []byte("x")}
+	if err := writeBulkRow(w, row, 5); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	if buf.String() != "1\ta\\tb\\nc\\\\\t\\N\t1\tx\n" {
+		t.Fatalf("%q", buf.String())
+	}
+
+	if err := writeBulkRow(w, row, 4); err == nil {
+		t.Fatal("column count mismatch should fail")
+	}
+}
+
+func TestLoadFixtures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures.yaml")
+	ioutil.WriteFile(path, []byte(`
+- table: user
+  rows:
+    - _ref: alice
+      name: alice
+    - name: $$bob
+- table: orders
+  rows:
+    - uid: $alice.id
+      last_uid: $user.id
+`), 0644)
+
+	fake := NewFake()
+	set, err := fake.Mysql().LoadFixtures(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, ok := set.Ref("alice", "id"); !ok || id != int64(1) {
+		t.Fatal(id)
+	}
+
+	executed := fake.Executed()
+	order := executed[len(executed)-1]
+	if order.Query != "INSERT INTO orders (`last_uid`,`uid`) VALUES (?,?)" || !reflect.DeepEqual(order.Args, []interface{}{int64(2), int64(1)}) {
+		t.Fatal(order)
+	}
+	if bob := executed[len(executed)-2]; bob.Args[0] != "$bob" {
+		t.Fatal(bob)
+	}
+	if executed[1].Query != "TRUNCATE TABLE user" || order.TxState != FakeCommitted {
+		t.Fatal(executed)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	db.TenantTable("orders", "")
+
+	type order struct {
+		Id int64 `db:"id"`
+	}
+	rows := fake.On("SELECT * FROM orders").ReturnRows([]string{"id"}, []interface{}{int64(11)}, []interface{}{int64(12)})
+
+	cfg := ChunkConfig{Table: "orders", Condition: map[string]interface{}{"state": 1}, Size: 2, Cursor: 10}
+	if _, err := db.Chunk(context.Background(), cfg, &[]order{}, nil); err != ErrNoTenant {
+		t.Fatal(err)
+	}
+
+	ctx := WithTenant(context.Background(), int64(7))
+	var orders []order
+	var handled []int64
+	cursor, err := db.Chunk(ctx, cfg, &orders, func(cursor int64) error {
+		handled = append(handled, cursor)
+		// a full batch is followed by a short one, which ends the scan
+		rows.ReturnRows([]string{"id"}, []interface{}{int64(13)})
+		return nil
+	})
+	if err != nil || cursor != 13 || !reflect.DeepEqual(handled, []int64{12, 13}) {
+		t.Fatal(cursor, handled, err)
+	}
+
+	executed := fake.Executed()
+	if len(executed) != 2 || executed[0].Query != "SELECT * FROM orders WHERE `state`=? AND `tenant_id`=? AND `id`>? ORDER BY `id` LIMIT ?" {
+		t.Fatal(executed)
+	}
+	if !reflect.DeepEqual(executed[0].Args, []interface{}{int64(1), int64(7), int64(10), int64(2)}) || executed[1].Args[2] != int64(12) {
+		t.Fatal(executed)
+	}
+
+	// a full last batch needs one more query to see the end
+	fake.Reset()
+	rows = fake.On("SELECT * FROM orders").ReturnRows([]string{"id"}, []interface{}{int64(11)}, []interface{}{int64(12)})
+	cursor, err = db.Chunk(ctx, cfg, &orders, func(cursor int64) error {
+		rows.ReturnRows([]string{"id"})
+		return nil
+	})
+	if err != nil || cursor != 12 || len(fake.Executed()) != 2 {
+		t.Fatal(cursor, fake.Executed(), err)
+	}
+
+	// a failed batch is not counted, the returned cursor retries it
+	fake.Reset()
+	fake.On("SELECT * FROM orders").ReturnRows([]string{"id"}, []interface{}{int64(11)}, []interface{}{int64(12)})
+	handleErr := errors.New("handle")
+	cursor, err = db.Chunk(ctx, cfg, &orders, func(cursor int64) error {
+		return handleErr
+	})
+	if err != handleErr || cursor != 10 || len(fake.Executed()) != 1 {
+		t.Fatal(cursor, fake.Executed(), err)
+	}
+}
+
+func TestSelectLock(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	type order struct {
+		Id int64 `db:"id"`
+	}
+	fake.On("SELECT * FROM orders").ReturnRows([]string{"id"}, []interface{}{int64(1)})
+
+	var orders []order
+	tx, _ := db.BeginTx()
+	if err := tx.SelectForUpdate(&orders, "orders", map[string]interface{}{"id": 1}, LockWaitDefault); err != nil || len(orders) != 1 {
+		t.Fatal(orders, err)
+	}
+	if err := tx.SelectForShare(&orders, "orders", map[string]interface{}{"id": 1}, LockWaitDefault); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SelectForUpdate(&orders, "orders", map[string]interface{}{"id": 1}, LockSkipLocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SelectForShare(&orders, "orders", map[string]interface{}{"id": 1}, LockNoWait); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	var queries []string
+	for _, record := range fake.Records() {
+		if record.TxState != FakeCommitted {
+			t.Fatal(record)
+		}
+		queries = append(queries, record.Query)
+	}
+	if !reflect.DeepEqual(queries, []string{
+		"SELECT * FROM orders WHERE `id`=? FOR UPDATE",
+		"SELECT * FROM orders WHERE `id`=? LOCK IN SHARE MODE",
+		"SELECT * FROM orders WHERE `id`=? FOR UPDATE SKIP LOCKED",
+		"SELECT * FROM orders WHERE `id`=? FOR SHARE NOWAIT",
+	}) {
+		t.Fatal(queries)
+	}
+
+	var outside *TxInstance
+	if err := outside.SelectForUpdate(&orders, "orders", nil, LockWaitDefault); err != ErrNoTx {
+		t.Fatal(err)
+	}
+	if err := tx.SelectForShare(&orders, "orders", nil, LockWaitDefault); err != ErrNoTx {
+		t.Fatal(err)
+	}
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	ctx := context.Background()
+
+	fake.On("GET_LOCK").ReturnRows([]string{"l"}, []interface{}{int64(0)})
+	if _, err := db.Lock(ctx, "job", time.Second); err != ErrLockTimeout {
+		t.Fatal(err)
+	}
+	if last := fake.Records()[0]; last.Args[0] != "job" || last.Args[1] != int64(1) {
+		t.Fatal(last)
+	}
+
+	fake.Reset()
+	fake.On("GET_LOCK").ReturnRows([]string{"l"}, []interface{}{int64(1)})
+	fake.On("RELEASE_LOCK").ReturnRows([]string{"l"}, []interface{}{int64(1)})
+
+	lock, err := db.Lock(ctx, "job", time.Millisecond*1500)
+	if err != nil || lock.Name() != "job" {
+		t.Fatal(lock, err)
+	}
+	// the session holding the lock is kept out of the pool, and pins it on reload
+	db.Exec("UPDATE job SET state=1")
+	old := db.DB()
+	replaced := make(chan error)
+	go func() {
+		replaced <- db.replace(NewFake().Mysql().pool)
+	}()
+	for db.DB() == old {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-replaced:
+		t.Fatal("replaced under the lock", err)
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-replaced; err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Unlock(); err != ErrLockReleased {
+		t.Fatal(err)
+	}
+	select {
+	case <-lock.Lost():
+		t.Fatal("lost")
+	default:
+	}
+
+	records := fake.Records()
+	if len(records) != 3 || records[0].Args[1] != int64(2) || records[2].Query != "SELECT RELEASE_LOCK(?)" {
+		t.Fatal(records)
+	}
+	if records[0].Conn != records[2].Conn || records[1].Conn == records[0].Conn {
+		t.Fatal(records)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	type order struct {
+		Id int64 `db:"id"`
+	}
+	query := PageQuery{Table: "orders", Condition: map[string]interface{}{"uid": 1}}
+
+	fake.On("COUNT(*)").ReturnRows([]string{"n"}, []interface{}{int64(45)})
+	fake.On("SELECT * FROM orders").ReturnRows([]string{"id"}, []interface{}{int64(21)}, []interface{}{int64(22)}, []interface{}{int64(23)})
+
+	var orders []order
+	page, err := db.Paginate(query, 2, 20, &orders)
+	if err != nil || page.Pages != 3 || !page.HasNext || page.Total != 45 {
+		t.Fatal(page, err)
+	}
+	if last := fake.Records()[1]; last.Query != "SELECT * FROM orders WHERE `uid`=? ORDER BY `id` LIMIT ? OFFSET ?" || last.Args[2] != int64(20) {
+		t.Fatal(last)
+	}
+
+	page, err = db.PaginateAfter(query, 20, 2, &orders)
+	if err != nil || !page.HasNext || page.Cursor != 22 || len(orders) != 2 {
+		t.Fatal(page, orders, err)
+	}
+	if last := fake.Records()[2]; last.Query != "SELECT * FROM orders WHERE `uid`=? AND `id`>? ORDER BY `id` LIMIT ?" {
+		t.Fatal(last)
+	}
+
+	// the first page of a descending scan has no cursor, the total is asked for
+	fake.Reset()
+	fake.On("COUNT(*)").ReturnRows([]string{"n"}, []interface{}{int64(45)})
+	fake.On("SELECT * FROM orders").ReturnRows([]string{"id"}, []interface{}{int64(23)}, []interface{}{int64(22)}, []interface{}{int64(21)})
+	query.Desc, query.Total = true, true
+	page, err = db.PaginateAfter(query, 0, 2, &orders)
+	if err != nil || page.Total != 45 || page.Cursor != 22 || len(orders) != 2 {
+		t.Fatal(page, orders, err)
+	}
+	if last := fake.Records()[1]; last.Query != "SELECT * FROM orders WHERE `uid`=? ORDER BY `id` DESC LIMIT ?" || len(last.Args) != 2 {
+		t.Fatal(last)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	recorder := NewRecorder()
+	db.SetTracer(recorder)
+
+	ctx := context.Background()
+	db.UpdateContext(ctx, "user", map[string]interface{}{"name": "a"}, map[string]interface{}{"id": 1})
+
+	tx, _ := db.BeginTxContext(ctx)
+	failErr := errors.New("fail")
+	fake.On("DELETE").ReturnError(failErr)
+	tx.DeleteContext(ctx, "user", map[string]interface{}{"id": 1})
+	tx.Rollback()
+
+	spans := recorder.Spans()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"db.Update", "db.BeginTx", "db.Delete", "db.Rollback"}) {
+		t.Fatal(names)
+	}
+
+	update := spans[0]
+	if update.Attributes[AttrStatement] != "UPDATE user SET `name`=? WHERE `id`=?" || update.Attributes[AttrTable] != "user" || update.Attributes[AttrRowsAffected] != int64(1) {
+		t.Fatal(update)
+	}
+	if spans[2].Err != failErr {
+		t.Fatal(spans[2])
+	}
+}
+
+func TestTenantTable(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	db.TenantTable("orders", "")
+
+	if _, err := db.Add("orders", map[string]interface{}{"amount": 1}); err != ErrNoTenant {
+		t.Fatal(err)
+	}
+	for _, zero := range []interface{}{"", 0, int64(0)} {
+		if _, err := db.DeleteContext(WithTenant(context.Background(), zero), "orders", map[string]interface{}{"id": 1}); err != ErrNoTenant {
+			t.Fatal(zero, err)
+		}
+	}
+	if len(fake.Records()) != 0 {
+		t.Fatal(fake.Records())
+	}
+
+	ctx := WithTenant(context.Background(), int64(7))
+	if _, err := db.AddContext(ctx, "orders", map[string]interface{}{"amount": 1, "tenant_id": 8}); err != ErrTenantMismatch {
+		t.Fatal(err)
+	}
+	if _, err := db.UpdateContext(ctx, "orders", map[string]interface{}{"tenant_id": 8}, map[string]interface{}{"id": 1}); err != ErrTenantMismatch {
+		t.Fatal(err)
+	}
+
+	db.AddContext(ctx, "orders", map[string]interface{}{"amount": 1})
+	tx, _ := db.BeginTxContext(ctx)
+	tx.Delete("orders", map[string]interface{}{"id": 1})
+	tx.Count("orders", nil)
+	tx.Commit()
+
+	executed := fake.Executed()
+	want := []string{
+		"INSERT INTO orders (`amount`,`tenant_id`) VALUES (?,?)",
+		"DELETE FROM orders WHERE `id`=? AND `tenant_id`=?",
+		"SELECT COUNT(*) FROM orders WHERE `tenant_id`=?",
+	}
+	if len(executed) != len(want) {
+		t.Fatal(executed)
+	}
+	for i, record := range executed {
+		if record.Query != want[i] || record.Args[len(record.Args)-1] != int64(7) {
+			t.Fatal(record)
+		}
+	}
+}
+
+// binlogFixture writes events to a checksummed binlog file the way the server lays them out.
+func binlogFixture(t *testing.T, events ...[]byte) (string, []uint32) {
+	var buf bytes.Buffer
+	var ends []uint32
+	buf.Write(binlogMagic)
+
+	for i := 0; i < len(events); i += 2 {
+		size := binlogHeaderSize + len(events[i+1]) + 4
+		event := make([]byte, binlogHeaderSize, size)
+		event[4] = events[i][0]
+		binary.LittleEndian.PutUint32(event[9:], uint32(size))
+		binary.LittleEndian.PutUint32(event[13:], uint32(buf.Len()+size))
+		event = append(event, events[i+1]...)
+		event = appendUint32(event, crc32.ChecksumIEEE(event))
+
+		buf.Write(event)
+		ends = append(ends, uint32(buf.Len()))
+	}
+
+	path := filepath.Join(t.TempDir(), "binlog.000001")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, ends
+}
+
+func TestCDC(t *testing.T) {
+	fde := make([]byte, 2+50+4+1+41+1)
+	copy(fde[2:], "8.0.36")
+	fde[len(fde)-1] = 1 // crc32
+
+	tableMap := []byte{1, 0, 0, 0, 0, 0, 0, 0, 4, 's', 'h', 'o', 'p', 0, 6, 'o', 'r', 'd', 'e', 'r', 's', 0, 4,
+		mysqlTypeLong, mysqlTypeVarchar, mysqlTypeNewDecimal, mysqlTypeDatetime2,
+		5, 0xff, 0, 10, 2, 0, 0}
+
+	datetime := make([]byte, 8)
+	ymd := int64(2024*13+5)<<5 | 6
+	binary.BigEndian.PutUint64(datetime, uint64(ymd<<17|7<<12|8<<6|9+0x8000000000))
+
+	row := func(name string) []byte {
+		if name == "" {
+			return append([]byte{0x02, 1, 0, 0, 0, 0x80, 0, 0, 12, 50}, datetime[3:]...)
+		}
+		b := append([]byte{0x00, 1, 0, 0, 0, byte(len(name))}, name...)
+		return append(append(b, 0x80, 0, 0, 12, 50), datetime[3:]...)
+	}
+	rowsHeader := []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 4, 0x0f}
+	xid := make([]byte, 8)
+
+	path, ends := binlogFixture(t,
+		[]byte{binlogFormatDescriptionEvent}, fde,
+		[]byte{binlogTableMapEvent}, tableMap,
+		[]byte{binlogWriteRowsEventV2}, append(append([]byte{}, rowsHeader...), row("a")...),
+		[]byte{binlogXidEvent}, xid,
+		[]byte{binlogTableMapEvent}, tableMap,
+		[]byte{binlogUpdateRowsEventV2}, append(append(append(append([]byte{}, rowsHeader...), 0x0f), row("a")...), row("")...),
+		[]byte{binlogXidEvent}, xid,
+	)
+
+	columns := ColumnResolverFunc(func(ctx context.Context, schema string, table string) ([]string, error) {
+		return []string{"id", "name", "amount", "created_at"}, nil
+	})
+	checkpoint := NewFileCheckpoint(filepath.Join(t.TempDir(), "pos.json"))
+
+	var events []RowEvent
+	cdc := NewCDCStreamer(NewBinlogFile(path), columns, checkpoint)
+	cdc.Handle("shop.orders", func(ctx context.Context, event RowEvent) error {
+		events = append(events, event)
+		return nil
+	})
+
+	if err := cdc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Action != RowInsert || events[0].Before != nil || events[1].Action != RowUpdate {
+		t.Fatal(events)
+	}
+	want := map[string]interface{}{"id": int64(1), "name": "a", "amount": "12.50", "created_at": "2024-05-06 07:08:09"}
+	if !reflect.DeepEqual(events[0].After, want) || !reflect.DeepEqual(events[1].Before, want) {
+		t.Fatal(events[0].After, events[1].Before)
+	}
+	if name, ok := events[1].After["name"]; !ok || name != nil {
+		t.Fatal(events[1].After)
+	}
+	if pos, _ := checkpoint.Load(); pos != (BinlogPosition{File: "binlog.000001", Pos: ends[6]}) {
+		t.Fatal(pos)
+	}
+
+	// resume after the first tx
+	checkpoint.Save(BinlogPosition{File: "binlog.000001", Pos: ends[3]})
+	events = nil
+	if err := cdc.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Action != RowUpdate {
+		t.Fatal(events)
+	}
+}
+
+func TestReload(t *testing.T) {
+	oldFake, newFake := NewFake(), NewFake()
+	db := oldFake.Mysql()
+
+	tx, _ := db.BeginTx()
+	tx.Add("user", map[string]interface{}{"name": "a"})
+
+	replaced := make(chan error)
+	go func() {
+		replaced <- db.replace(newFake.Mysql().pool)
+	}()
+
+	// new statements move to the new pool while the tx drains on the old one
+	for db.DB() == tx.pool.db {
+		time.Sleep(time.Millisecond)
+	}
+	db.Add("user", map[string]interface{}{"name": "b"})
+	select {
+	case err := <-replaced:
+		t.Fatal("replaced before the tx ended", err)
+	default:
+	}
+
+	tx.Add("user", map[string]interface{}{"name": "c"})
+	tx.Commit()
+	if err := <-replaced; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(oldFake.Executed()) != 2 || len(newFake.Executed()) != 1 {
+		t.Fatal(oldFake.Executed(), newFake.Executed())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	db.SetLimits(Limits{Timeout: time.Millisecond * 50, MaxRows: 2, TableConcurrency: 1})
+
+	db.Count("user", nil)
+	if records := fake.Records(); records[0].Query != "SELECT /*+ MAX_EXECUTION_TIME(50) */ COUNT(*) FROM user" {
+		t.Fatal(records[0].Query)
+	}
+
+	type user struct {
+		Id int64 `db:"id"`
+	}
+	fake.On("SELECT").ReturnRows([]string{"id"}, []interface{}{int64(1)}, []interface{}{int64(2)}, []interface{}{int64(3)})
+	var users []user
+	if err := db.CachedQuery("user", time.Minute, &users, "SELECT id FROM user"); err != ErrTooManyRows {
+		t.Fatal(err)
+	}
+
+	st, _ := db.guard(context.Background(), "user", "")
+	if _, err := db.Count("user", nil); err != ErrTableBusy {
+		t.Fatal(err)
+	}
+	st.finish(nil)
+	if _, err := db.Count("user", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// changing the limits of a live instance, run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			db.SetLimits(Limits{Timeout: time.Second, TableConcurrency: 4})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		db.Count("user", nil)
+	}
+	<-done
+}
+
+func TestBreaker(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	db.SetBreaker(BreakerConfig{MinRequests: 2, Cooldown: time.Millisecond * 20})
+
+	fake.On("INSERT").ReturnError(&mysqlDriver.MySQLError{Number: 2013, Message: "Lost connection to MySQL server during query"})
+	db.Add("user", map[string]interface{}{"name": "a"})
+	db.Add("user", map[string]interface{}{"name": "a"})
+
+	_, err := db.Add("user", map[string]interface{}{"name": "a"})
+	var open *CircuitOpenError
+	if !errors.Is(err, ErrCircuitOpen) || !errors.As(err, &open) || len(fake.Records()) != 2 {
+		t.Fatal(err, fake.Records())
+	}
+
+	// a successful probe closes the circuit after the cooldown
+	time.Sleep(time.Millisecond * 30)
+	fake.Reset()
+	if _, err := db.Add("user", map[string]interface{}{"name": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Add("user", map[string]interface{}{"name": "a"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	db.Update("product", map[string]interface{}{
+		"attrs": JSONSet(map[string]interface{}{"$.tags": []string{"sale"}, "$.color": "red"}),
+		"name":  "shirt",
+	}, map[string]interface{}{
+		"attrs": JSONPath("$.size", "M"),
+		"tags":  JSONContains("sale", "$.list"),
+	})
+
+	record := fake.Records()[0]
+	if record.Query != "UPDATE product SET `attrs`=JSON_SET(COALESCE(`attrs`,JSON_OBJECT()),?,CAST(? AS JSON),?,CAST(? AS JSON)),`name`=?"+
+		" WHERE JSON_UNQUOTE(JSON_EXTRACT(`attrs`,?))=? AND JSON_CONTAINS(`tags`,?,?)" {
+		t.Fatal(record.Query)
+	}
+	want := []interface{}{"$.color", `"red"`, "$.tags", `["sale"]`, "shirt", "$.size", "M", `"sale"`, "$.list"}
+	if !reflect.DeepEqual(record.Args, want) {
+		t.Fatal(record.Args)
+	}
+
+	type attrs struct {
+		Color string `json:"color"`
+	}
+	var a attrs
+	j := JSON{V: &a}
+	if err := j.Scan([]byte(`{"color":"red"}`)); err != nil || a.Color != "red" {
+		t.Fatal(a, err)
+	}
+	if v, _ := (JSON{V: a}).Value(); v != `{"color":"red"}` {
+		t.Fatal(v)
+	}
+}
+
+func TestTables(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	fake.On("information_schema.TABLES").ReturnRows([]string{"table_name", "table_comment"},
+		[]interface{}{"order", "orders"},
+		[]interface{}{"user", ""},
+	)
+	fake.On("information_schema.COLUMNS").ReturnRows(
+		[]string{"table_name", "column_name", "ordinal_position", "column_default", "is_nullable", "data_type", "column_type", "column_key", "extra", "column_comment"},
+		[]interface{}{"order", "id", int64(1), nil, "NO", "bigint", "bigint unsigned", "PRI", "auto_increment", ""},
+		[]interface{}{"order", "uid", int64(2), "0", "NO", "bigint", "bigint", "MUL", "", ""},
+		[]interface{}{"order_view", "id", int64(1), nil, "NO", "bigint", "bigint", "", "", ""},
+		[]interface{}{"user", "id", int64(1), nil, "NO", "bigint", "bigint", "PRI", "", ""},
+	)
+	fake.On("information_schema.STATISTICS").ReturnRows([]string{"table_name", "index_name", "non_unique", "column_name"},
+		[]interface{}{"order", "PRIMARY", int64(0), "id"},
+		[]interface{}{"order", "idx_uid_id", int64(1), "uid"},
+		[]interface{}{"order", "idx_uid_id", int64(1), "id"},
+		[]interface{}{"user", "uk_id", int64(0), "id"},
+	)
+
+	tables, err := db.Tables("shop")
+	if err != nil || len(tables) != 2 {
+		t.Fatal(tables, err)
+	}
+	if fake.Records()[0].Args[0] != "shop" {
+		t.Fatal(fake.Records())
+	}
+
+	// columns and indexes land on their table, the view's are dropped
+	order, user := tables[0], tables[1]
+	if order.Name != "order" || order.Comment != "orders" || len(order.Columns) != 2 || order.Columns[1].Default.String != "0" || len(user.Columns) != 1 {
+		t.Fatal(tables)
+	}
+	if !reflect.DeepEqual(order.Indexes, []Index{
+		{Name: "PRIMARY", Unique: true, Columns: []string{"id"}},
+		{Name: "idx_uid_id", Columns: []string{"uid", "id"}},
+	}) {
+		t.Fatal(order.Indexes)
+	}
+	if !reflect.DeepEqual(user.Indexes, []Index{{Name: "uk_id", Unique: true, Columns: []string{"id"}}}) {
+		t.Fatal(user.Indexes)
+	}
+}
+
+func TestSchemaDiff(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	fake.On("information_schema.TABLES").ReturnRows([]string{"table_name", "table_comment"}, []interface{}{"user", ""})
+	fake.On("information_schema.COLUMNS").ReturnRows(
+		[]string{"table_name", "column_name", "ordinal_position", "column_default", "is_nullable", "data_type", "column_type", "column_key", "extra", "column_comment"},
+		[]interface{}{"user", "id", int64(1), nil, "NO", "bigint", "bigint unsigned", "PRI", "auto_increment", ""},
+		[]interface{}{"user", "name", int64(2), "", "YES", "varchar", "varchar(32)", "", "", "nick"},
+		[]interface{}{"user", "age", int64(3), nil, "NO", "int", "int(11)", "", "", ""},
+		[]interface{}{"user", "score", int64(4), nil, "NO", "bigint", "bigint", "", "", ""},
+	)
+	fake.On("information_schema.STATISTICS").ReturnRows([]string{"table_name", "index_name", "non_unique", "column_name"},
+		[]interface{}{"user", "PRIMARY", int64(0), "id"},
+		[]interface{}{"user", "idx_name_age", int64(1), "name"},
+		[]interface{}{"user", "idx_name_age", int64(1), "age"},
+	)
+
+	type user struct {
+		Id    uint64 `db:"id" schema:"primary"`
+		Name  string `db:"name" schema:"type:varchar(64);index:idx_name"`
+		Age   int32  `db:"age" schema:"type:int"`
+		Score int32  `db:"score"`
+		Email string `db:"email" schema:"unique"`
+	}
+	type order struct {
+		Id int64 `db:"id" schema:"primary"`
+	}
+
+	drifts, err := db.Diff("shop", ModelOf("user", user{}), ModelOf("order", &order{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, d := range drifts {
+		got = append(got, d.String())
+	}
+	want := []string{
+		"user.name: type mismatch, model varchar(64), table varchar(32)",
+		"user.name: nullability, model NOT NULL, table NULL",
+		"user.score: type mismatch, model int32, table bigint",
+		"user.email: missing column, model string",
+		"user.uk_email: missing index, model UNIQUE INDEX (email)",
+		"order: missing table, model order",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal(strings.Join(got, "\n"))
+	}
+
+	want = []string{
+		"ALTER TABLE `user` MODIFY COLUMN `name` varchar(64) NOT NULL DEFAULT '' COMMENT 'nick'",
+		"ALTER TABLE `user` ADD COLUMN `email` varchar(255) NOT NULL",
+		"ALTER TABLE `user` ADD UNIQUE INDEX `uk_email` (`email`)",
+		"CREATE TABLE `order` (`id` bigint NOT NULL,PRIMARY KEY (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	}
+	if alters := Alters(drifts); !reflect.DeepEqual(alters, want) {
+		t.Fatal(strings.Join(alters, "\n"))
+	}
+}
+
+func TestExplain(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+	db.SetExplain(true)
+
+	fake.On("EXPLAIN").ReturnRows([]string{"id", "select_type", "table", "type", "possible_keys", "key", "rows", "Extra"},
+		[]interface{}{int64(1), "SIMPLE", "user", "ALL", "idx_city", nil, int64(1000), "Using where; Using temporary; Using filesort"},
+		[]interface{}{int64(1), "SIMPLE", "order", "ref", "idx_uid", "idx_uid", int64(3), nil},
+	)
+	fake.On("SELECT").ReturnRows([]string{"id"}, []interface{}{int64(1)})
+
+	for i := 0; i < 2; i++ {
+		rows, err := db.Query("SELECT id FROM user JOIN `order` ON uid=user.id WHERE city=? GROUP BY age ORDER BY name", "sz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+	db.Exec("UPDATE user SET age=1")
+
+	var explained int
+	for _, r := range fake.Records() {
+		if strings.HasPrefix(r.Query, "EXPLAIN SELECT id FROM user") && reflect.DeepEqual(r.Args, []interface{}{"sz"}) {
+			explained++
+		}
+	}
+	if explained != 1 || len(fake.Records()) != 4 {
+		t.Fatal(fake.Records())
+	}
+
+	// the helpers are explained too, inside a tx as well
+	fake.Reset()
+	db.Count("user", map[string]interface{}{"city": "sz"})
+	tx, _ := db.BeginTx()
+	var users []struct {
+		Id int64 `db:"id"`
+	}
+	tx.SelectForUpdate(&users, "user", map[string]interface{}{"id": 1}, LockWaitDefault)
+	tx.Rollback()
+
+	var queries []string
+	for _, r := range fake.Records() {
+		if strings.HasPrefix(r.Query, "EXPLAIN") {
+			queries = append(queries, r.Query)
+		}
+	}
+	want := []string{"EXPLAIN SELECT COUNT(*) FROM user WHERE `city`=?", "EXPLAIN SELECT * FROM user WHERE `id`=? FOR UPDATE"}
+	if !reflect.DeepEqual(queries, want) {
+		t.Fatal(queries)
+	}
+
+	warnings := planWarnings([]map[string]interface{}{
+		{"table": "user", "type": "ALL", "possible_keys": "idx_city", "key": nil, "rows": "1000", "Extra": "Using where; Using temporary; Using filesort"},
+		{"table": "order", "type": "ref", "possible_keys": "idx_uid", "key": "idx_uid", "rows": "3", "Extra": nil},
+		{"table": "<derived2>", "type": "ALL", "rows": "10"},
+	})
+	want = []string{"full table scan on user (1000 rows)", "unused indexes idx_city on user", "filesort on user", "temporary table on user"}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Fatal(warnings)
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	columns := []string{"request_hash", "status", "response", "expired"}
+	var calls int
+	charge := func() ([]byte, error) {
+		calls++
+		return []byte(`{"id":1}`), nil
+	}
+
+	tx, _ := db.BeginTx()
+	response, replayed, err := tx.Idempotent("pay-1", []byte("amount=10"), 0, charge)
+	tx.Commit()
+	if err != nil || replayed || string(response) != `{"id":1}` || calls != 1 {
+		t.Fatal(string(response), replayed, err)
+	}
+	executed := fake.Executed()
+	if len(executed) != 3 || !strings.HasPrefix(executed[1].Query, "INSERT INTO db_idempotency") ||
+		executed[2].Query != "UPDATE db_idempotency SET `response`=?,`status`=? WHERE `idempotency_key`=?" {
+		t.Fatal(executed)
+	}
+	if executed[1].Args[3] != int64(86400) {
+		t.Fatal(executed[1].Args)
+	}
+
+	// a repeat replays the stored response
+	fake.Reset()
+	sum := sha256.Sum256([]byte("amount=10"))
+	fake.On("FOR UPDATE NOWAIT").ReturnRows(columns, []interface{}{hex.EncodeToString(sum[:]), int64(IdempotencyDone), []byte(`{"id":1}`), int64(0)})
+	tx, _ = db.BeginTx()
+	response, replayed, err = tx.Idempotent("pay-1", []byte("amount=10"), time.Hour, charge)
+	if err != nil || !replayed || string(response) != `{"id":1}` || calls != 1 {
+		t.Fatal(string(response), replayed, err)
+	}
+
+	if _, _, err := tx.Idempotent("pay-1", []byte("amount=20"), time.Hour, charge); err != ErrIdempotencyMismatch {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	// a key held by a running tx
+	fake.Reset()
+	fake.On("FOR UPDATE NOWAIT").ReturnError(&mysqlDriver.MySQLError{Number: 3572, Message: "Statement aborted because lock(s) could not be acquired immediately and NOWAIT is set."})
+	tx, _ = db.BeginTx()
+	_, _, err = tx.Idempotent("pay-1", []byte("amount=10"), time.Hour, charge)
+	tx.Rollback()
+	var inProgress *InProgressError
+	if !errors.As(err, &inProgress) || inProgress.Key != "pay-1" || !errors.Is(err, ErrIdempotencyInProgress) || !errors.Is(err, ErrLockNoWait) {
+		t.Fatal(err)
+	}
+
+	// an expired key is taken over
+	fake.Reset()
+	fake.On("FOR UPDATE NOWAIT").ReturnRows(columns, []interface{}{"other", int64(IdempotencyDone), nil, int64(1)})
+	tx, _ = db.BeginTx()
+	if _, replayed, err := tx.Idempotent("pay-1", []byte("amount=10"), time.Hour, charge); err != nil || replayed || calls != 2 {
+		t.Fatal(replayed, err)
+	}
+	tx.Commit()
+	if executed := fake.Executed(); len(executed) != 4 || executed[1].Query != "DELETE FROM db_idempotency WHERE `idempotency_key`=?" {
+		t.Fatal(executed)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	fake := NewFake()
+	db := fake.Mysql()
+
+	rows := [][]interface{}{{int64(1), "a"}, {int64(2), "b"}}
+	source := func() RowSource {
+		var n int
+		return RowSourceFunc(func() ([]interface{}, error) {
+			if n == len(rows) {
+				return nil, io.EOF
+			}
+			n++
+			return rows[n-1], nil
+		})
+	}
+
+	fake.On("@@warning_count").ReturnRows([]string{"w"}, []interface{}{int64(1)})
+	result, err := db.BulkLoad(context.Background(), "user", []string{"id", "name"}, source())
+	if err != nil || result.Warnings != 1 {
+		t.Fatal(result, err)
+	}
+	executed := fake.Executed()
+	if len(executed) != 2 || !strings.HasSuffix(executed[0].Query, "INTO TABLE user CHARACTER SET utf8mb4 (`id`,`name`)") || executed[0].TxState != FakeCommitted {
+		t.Fatal(executed)
+	}
+
+	// a failed load leaves nothing behind
+	fake.Reset()
+	loadErr := errors.New("source failed")
+	fake.On("LOAD DATA").ReturnError(loadErr)
+	if _, err := db.BulkLoad(context.Background(), "user", []string{"id", "name"}, source()); err != loadErr {
+		t.Fatal(err)
+	}
+	if records := fake.Records(); len(records) != 1 || records[0].TxState != FakeRolledBack {
+		t.Fatal(records)
+	}
+
+	// an endless source is stopped when the load cannot start
+	fake.Reset()
+	fake.On("BEGIN").ReturnError(loadErr)
+	endless := RowSourceFunc(func() ([]interface{}, error) {
+		return []interface{}{int64(1), strings.Repeat("a", 1024)}, nil
+	})
+	if _, err := db.BulkLoad(context.Background(), "user", []string{"id", "name"}, endless); err != loadErr {
+		t.Fatal(err)
+	}
+}
+
+func TestShardRouter(t *testing.T) {
+	even, odd := NewFake(), NewFake()
+	evenDB, oddDB := even.Mysql(), odd.Mysql()
+	fakes := map[*Mysql]*Fake{evenDB: even, oddDB: odd}
+	router := NewShardRouterWith("order", map[string]*Mysql{"00": evenDB, "01": oddDB})
+	defer router.Close()
+
+	if _, err := router.Add(int64(3), map[string]interface{}{"uid": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.Update("u2", map[string]interface{}{"state": 1}, map[string]interface{}{"uid": "u2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if records := odd.Records(); len(records) == 0 || records[0].Query != "INSERT INTO order_01 (`uid`) VALUES (?)" {
+		t.Fatal(records)
+	}
+	table, db, _ := router.Shard("u2")
+	if records := fakes[db].Records(); records[len(records)-1].Query != "UPDATE "+table+" SET `state`=? WHERE `uid`=?" {
+		t.Fatal(records)
+	}
+	if _, _, err := router.Shard(1.5); err != ErrShardKey {
+		t.Fatal(err)
+	}
+
+	// keys past 32 bits route as key % count
+	tens := make(map[string]*Mysql)
+	for n := 0; n < 10; n++ {
+		tens[fmt.Sprintf("%02d", n)] = evenDB
+	}
+	for key, want := range map[interface{}]string{int64(1<<32 + 5): "order_01", uint64(1<<40 + 7): "order_03", int64(-(1<<32 + 5)): "order_01"} {
+		if table, _, _ := NewShardRouterWith("order", tens).Shard(key); table != want {
+			t.Fatal(key, table, want)
+		}
+	}
+	if tables := router.Tables(); len(tables) != 2 || tables["order_00"] == nil {
+		t.Fatal(tables)
+	}
+
+	even.Reset()
+	odd.Reset()
+	even.On("SELECT").ReturnRows([]string{"id"}, []interface{}{int64(4)}, []interface{}{int64(2)})
+	odd.On("SELECT").ReturnRows([]string{"id"}, []interface{}{int64(3)})
+
+	type order struct {
+		Id int64 `db:"id"`
+	}
+	var orders []order
+	if err := router.QueryAll(&orders, "SELECT id FROM "+ShardTable+" ORDER BY id DESC"); err != nil {
+		t.Fatal(err)
+	}
+	// shard order, not merged
+	if !reflect.DeepEqual(orders, []order{{4}, {2}, {3}}) {
+		t.Fatal(orders)
+	}
+	if q := even.Records()[0].Query; q != "SELECT id FROM order_00 ORDER BY id DESC" {
+		t.Fatal(q)
+	}
+
+	odd.Reset()
+	odd.On("SELECT").ReturnError(errors.New("shard down"))
+	if err := router.QueryAll(&orders, "SELECT id FROM "+ShardTable); err == nil {
+		t.Fatal("a failed shard should fail QueryAll")
+	}
+}
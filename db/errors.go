@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"regexp"
+)
+
+var (
+	ErrDuplicate       = errors.New("duplicate key")
+	ErrDeadlock        = errors.New("deadlock")
+	ErrLockWaitTimeout = errors.New("lock wait timeout")
+	ErrLockNoWait      = errors.New("row locked, nowait")
+	ErrForeignKey      = errors.New("foreign key violation")
+	ErrConnLost        = errors.New("connection lost")
+	ErrReadOnly        = errors.New("read only")
+	ErrNotNull         = errors.New("column cannot be null")
+	ErrDataTooLong     = errors.New("data too long")
+	ErrNoSuchTable     = errors.New("no such table")
+	ErrBadField        = errors.New("unknown column")
+	ErrQueryTimeout    = errors.New("query timeout")
+	ErrTooManyConns    = errors.New("too many connections")
+	ErrAccessDenied    = errors.New("access denied")
+)
+
+// mysql error numbers, see https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+var mysqlErrors = map[uint16]error{
+	1062: ErrDuplicate,
+	1586: ErrDuplicate,
+	1213: ErrDeadlock,
+	1205: ErrLockWaitTimeout,
+	3572: ErrLockNoWait,
+	1216: ErrForeignKey,
+	1217: ErrForeignKey,
+	1451: ErrForeignKey,
+	1452: ErrForeignKey,
+	2006: ErrConnLost,
+	2013: ErrConnLost,
+	1290: ErrReadOnly,
+	1792: ErrReadOnly,
+	1836: ErrReadOnly,
+	1048: ErrNotNull,
+	1406: ErrDataTooLong,
+	1146: ErrNoSuchTable,
+	1054: ErrBadField,
+	3024: ErrQueryTimeout,
+	1040: ErrTooManyConns,
+	1045: ErrAccessDenied,
+	1044: ErrAccessDenied,
+}
+
+var (
+	duplicateRegexp  = regexp.MustCompile(`Duplicate entry '(.*)' for key '([^']+)'`)
+	constraintRegexp = regexp.MustCompile("CONSTRAINT `([^`]+)`")
+	columnRegexp     = regexp.MustCompile(`[Cc]olumn '([^']+)'`)
+)
+
+/*
+ * MysqlError
+ *
+ * Classified driver error. errors.Is matches the sentinel Kind, errors.As
+ * still reaches the underlying *mysql.MySQLError. Key is the duplicate key,
+ * constraint or column name and Value the duplicate entry, when the server
+ * message carries them.
+ */
+type MysqlError struct {
+	Kind   error
+	Number uint16
+	Key    string
+	Value  string
+	Err    error
+}
+
+func (e *MysqlError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MysqlError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MysqlError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// Classify wraps known driver errors into *MysqlError, other errors are returned as is.
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *MysqlError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	if errors.Is(err, mysqlDriver.ErrInvalidConn) || errors.Is(err, driver.ErrBadConn) {
+		return &MysqlError{Kind: ErrConnLost, Err: err}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &MysqlError{Kind: ErrQueryTimeout, Err: err}
+	}
+
+	var driverErr *mysqlDriver.MySQLError
+	if !errors.As(err, &driverErr) {
+		return err
+	}
+
+	kind, ok := mysqlErrors[driverErr.Number]
+	if !ok {
+		return err
+	}
+
+	e := &MysqlError{Kind: kind, Number: driverErr.Number, Err: err}
+	switch kind {
+	case ErrDuplicate:
+		if m := duplicateRegexp.FindStringSubmatch(driverErr.Message); m != nil {
+			e.Value, e.Key = m[1], m[2]
+		}
+	case ErrForeignKey:
+		if m := constraintRegexp.FindStringSubmatch(driverErr.Message); m != nil {
+			e.Key = m[1]
+		}
+	case ErrNotNull, ErrDataTooLong, ErrBadField:
+		if m := columnRegexp.FindStringSubmatch(driverErr.Message); m != nil {
+			e.Key = m[1]
+		}
+	}
+
+	return e
+}
+
+func IsDuplicate(err error) bool {
+	return errors.Is(Classify(err), ErrDuplicate)
+}
+
+// IsRetryable reports errors after which the whole statement or tx may be retried: the server
+// rolled it back. A lost connection is not one of them, see IsConnLost.
+func IsRetryable(err error) bool {
+	err = Classify(err)
+	return errors.Is(err, ErrDeadlock) || errors.Is(err, ErrLockWaitTimeout)
+}
+
+/*
+ * IsConnLost reports a connection lost during the statement. Its outcome is
+ * unknown when an autocommit write or a COMMIT had been sent: retry only
+ * idempotent work, or check whether the write landed first.
+ */
+func IsConnLost(err error) bool {
+	return errors.Is(Classify(err), ErrConnLost)
+}
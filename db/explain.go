@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"strings"
+	"sync"
+)
+
+// maxExplained bounds the statements remembered, later new ones are not explained.
+const maxExplained = 10000
+
+type explainer struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+/*
+ * SetExplain
+ *
+ * For development: the first time a SELECT is run through Query, QueryRow,
+ * TxInstance.Query or a select helper (Count, Sum, Max, Paginate, Chunk,
+ * SelectForUpdate, ...), db runs EXPLAIN on it with the same args and warns
+ * through dwarflog.Warn about full table scans, filesorts, temporary tables
+ * and possible indexes left unused. MysqlConfig.Explain turns it on from the
+ * config. Each EXPLAIN is a round trip, keep it off in production.
+ */
+func (db *Mysql) SetExplain(enabled bool) {
+	if !enabled {
+		db.explainer = nil
+		return
+	}
+	db.explainer = &explainer{seen: make(map[string]bool)}
+}
+
+func SetExplain(enabled bool) {
+	mysql.SetExplain(enabled)
+}
+
+// first reports whether query is new, and remembers it.
+func (e *explainer) first(query string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.seen[query] || len(e.seen) >= maxExplained {
+		return false
+	}
+	e.seen[query] = true
+	return true
+}
+
+func explainable(query string) bool {
+	trimmed := strings.ToUpper(strings.TrimLeft(query, " \t\r\n("))
+	if !strings.HasPrefix(trimmed, "SELECT") && !strings.HasPrefix(trimmed, "WITH") {
+		return false
+	}
+	// the plans of the dictionary views are full scans by design
+	return !strings.Contains(trimmed, "INFORMATION_SCHEMA")
+}
+
+func (db *Mysql) explain(ctx context.Context, query string, args []interface{}) {
+	if db == nil || db.explainer == nil || !explainable(query) || !db.explainer.first(query) {
+		return
+	}
+
+	p, done := db.acquire()
+	defer done()
+
+	rows, err := p.db.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		// the statement itself reports it
+		return
+	}
+	defer rows.Close()
+
+	plan, err := ScanMaps(rows)
+	if err != nil {
+		return
+	}
+
+	if warnings := planWarnings(plan); len(warnings) > 0 {
+		dwarflog.Warn("【Explain】", strings.Join(warnings, "; "), query)
+	}
+}
+
+// planWarnings reads the rows of a traditional EXPLAIN.
+func planWarnings(plan []map[string]interface{}) []string {
+	var warnings []string
+	for _, row := range plan {
+		values := make(map[string]string, len(row))
+		for column, value := range row {
+			if value != nil {
+				values[strings.ToLower(column)] = fmt.Sprint(value)
+			}
+		}
+
+		table := values["table"]
+		if table == "" || strings.HasPrefix(table, "<") {
+			// no table read, or a derived table or union result
+			continue
+		}
+
+		if values["type"] == "ALL" {
+			warnings = append(warnings, fmt.Sprintf("full table scan on %s (%s rows)", table, values["rows"]))
+		}
+		if values["possible_keys"] != "" && values["key"] == "" {
+			warnings = append(warnings, fmt.Sprintf("unused indexes %s on %s", values["possible_keys"], table))
+		}
+		if strings.Contains(values["extra"], "Using filesort") {
+			warnings = append(warnings, "filesort on "+table)
+		}
+		if strings.Contains(values["extra"], "Using temporary") {
+			warnings = append(warnings, "temporary table on "+table)
+		}
+	}
+
+	return warnings
+}
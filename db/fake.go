@@ -0,0 +1,366 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const fakeDriverName = "dbfake"
+
+const (
+	FakeAutoCommit = FakeTxState("")
+	FakeOpen       = FakeTxState("open")
+	FakeCommitted  = FakeTxState("committed")
+	FakeRolledBack = FakeTxState("rolledback")
+)
+
+// Executor is the core of *Mysql: the write helpers, raw statements and BeginTx, for code that
+// should run against a Fake in tests. Code using the other helpers takes the *Mysql of Fake.Mysql.
+type Executor interface {
+	Add(table string, insertData map[string]interface{}) (int64, error)
+	Update(table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error)
+	Delete(table string, condition map[string]interface{}) (int64, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	BeginTx() (*TxInstance, error)
+}
+
+var _ Executor = (*Mysql)(nil)
+
+type FakeTxState string
+
+// FakeRecord is a statement seen by a Fake. Args hold driver values, so ints are int64.
+type FakeRecord struct {
+	Query   string
+	Args    []interface{}
+	TxState FakeTxState
+	Conn    int // numbers the driver connection that ran it, from 1
+}
+
+type FakeExpectation struct {
+	pattern      string
+	lastInsertId int64
+	rowsAffected int64
+	columns      []string
+	rows         [][]interface{}
+	err          error
+}
+
+// Return scripts the result of matching INSERT/UPDATE/DELETE statements.
+func (e *FakeExpectation) Return(lastInsertId int64, rowsAffected int64) *FakeExpectation {
+	e.lastInsertId, e.rowsAffected = lastInsertId, rowsAffected
+	return e
+}
+
+// ReturnRows scripts the rows of matching queries.
+func (e *FakeExpectation) ReturnRows(columns []string, rows ...[]interface{}) *FakeExpectation {
+	e.columns, e.rows = columns, rows
+	return e
+}
+
+// ReturnError makes matching statements fail with err. Use "BEGIN", "COMMIT" or "ROLLBACK" to fail the tx itself.
+func (e *FakeExpectation) ReturnError(err error) *FakeExpectation {
+	e.err = err
+	return e
+}
+
+/*
+ * Fake
+ *
+ * In-memory stand-in for MySQL, registered as a database/sql driver so that
+ * the real helpers, statement cache and TxInstance run unchanged. Every
+ * statement is recorded; statements of a tx are marked committed or rolled
+ * back when it ends. Unscripted statements succeed with an increasing
+ * insert id and one affected row, unscripted queries return no rows.
+ *
+ * db logs failed statements with dwarflog, which must be set up first: a
+ * test scripting errors with ReturnError calls dwarflog.Setup, e.g. in
+ * TestMain.
+ */
+type Fake struct {
+	name         string
+	mu           sync.Mutex
+	expectations []*FakeExpectation
+	records      []*FakeRecord
+	lastInsertId int64
+	conns        int
+}
+
+var (
+	fakes     = make(map[string]*Fake)
+	fakesMu   sync.Mutex
+	fakeCount int
+)
+
+func init() {
+	sql.Register(fakeDriverName, fakeDriver{})
+}
+
+func NewFake() *Fake {
+	fakesMu.Lock()
+	defer fakesMu.Unlock()
+
+	fakeCount++
+	f := &Fake{name: fmt.Sprintf("fake%d", fakeCount)}
+	fakes[f.name] = f
+
+	return f
+}
+
+// Mysql returns a *Mysql backed by the fake.
+func (f *Fake) Mysql() *Mysql {
+	instance, err := sql.Open(fakeDriverName, f.name)
+	if err != nil {
+		panic(err)
+	}
+
+	return newMysql(&pool{db: instance, stmts: newStmtCache(defaultStmtCacheSize)})
+}
+
+// On scripts statements containing pattern. The first matching expectation wins.
+func (f *Fake) On(pattern string) *FakeExpectation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	e := &FakeExpectation{pattern: pattern, rowsAffected: 1}
+	f.expectations = append(f.expectations, e)
+
+	return e
+}
+
+// Records returns every statement seen so far, including rolled back ones.
+func (f *Fake) Records() []FakeRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records := make([]FakeRecord, len(f.records))
+	for i, r := range f.records {
+		records[i] = *r
+	}
+
+	return records
+}
+
+// Executed returns the statements that took effect: autocommit and committed ones.
+func (f *Fake) Executed() []FakeRecord {
+	var executed []FakeRecord
+	for _, r := range f.Records() {
+		if r.TxState == FakeAutoCommit || r.TxState == FakeCommitted {
+			executed = append(executed, r)
+		}
+	}
+
+	return executed
+}
+
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.expectations, f.records, f.lastInsertId = nil, nil, 0
+}
+
+func (f *Fake) match(query string) *FakeExpectation {
+	for _, e := range f.expectations {
+		if strings.Contains(query, e.pattern) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (f *Fake) record(c *fakeConn, query string, args []driver.Value) *FakeExpectation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := &FakeRecord{Query: query, Conn: c.id}
+	for _, arg := range args {
+		r.Args = append(r.Args, arg)
+	}
+	if c.tx != nil {
+		r.TxState = FakeOpen
+		c.tx.records = append(c.tx.records, r)
+	}
+	f.records = append(f.records, r)
+
+	return f.match(query)
+}
+
+func (f *Fake) txEvent(event string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if e := f.match(event); e != nil {
+		return e.err
+	}
+
+	return nil
+}
+
+func (f *Fake) endTx(tx *fakeTx, state FakeTxState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, r := range tx.records {
+		r.TxState = state
+	}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakesMu.Lock()
+	defer fakesMu.Unlock()
+
+	f, ok := fakes[name]
+	if !ok {
+		return nil, fmt.Errorf("dbfake: unknown fake %q", name)
+	}
+
+	f.mu.Lock()
+	f.conns++
+	c := &fakeConn{fake: f, id: f.conns}
+	f.mu.Unlock()
+
+	return c, nil
+}
+
+type fakeConn struct {
+	fake *Fake
+	id   int
+	tx   *fakeTx
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	if err := c.fake.txEvent("BEGIN"); err != nil {
+		return nil, err
+	}
+
+	c.tx = &fakeTx{conn: c}
+	return c.tx, nil
+}
+
+type fakeTx struct {
+	conn    *fakeConn
+	records []*FakeRecord
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.conn.tx = nil
+	if err := tx.conn.fake.txEvent("COMMIT"); err != nil {
+		tx.conn.fake.endTx(tx, FakeRolledBack)
+		return err
+	}
+
+	tx.conn.fake.endTx(tx, FakeCommitted)
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.conn.tx = nil
+	tx.conn.fake.endTx(tx, FakeRolledBack)
+
+	return tx.conn.fake.txEvent("ROLLBACK")
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	f := s.conn.fake
+	e := f.record(s.conn, s.query, args)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if e != nil {
+		if e.err != nil {
+			return nil, e.err
+		}
+		return fakeResult{lastInsertId: e.lastInsertId, rowsAffected: e.rowsAffected}, nil
+	}
+
+	var lastInsertId int64
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(s.query)), "INSERT") {
+		f.lastInsertId++
+		lastInsertId = f.lastInsertId
+	}
+
+	return fakeResult{lastInsertId: lastInsertId, rowsAffected: 1}, nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	e := s.conn.fake.record(s.conn, s.query, args)
+	if e == nil {
+		return &fakeRows{}, nil
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	return &fakeRows{columns: e.columns, rows: e.rows}, nil
+}
+
+type fakeResult struct {
+	lastInsertId int64
+	rowsAffected int64
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.lastInsertId, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]interface{}
+	pos     int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+
+	for i, v := range r.rows[r.pos] {
+		dest[i] = v
+	}
+	r.pos++
+
+	return nil
+}
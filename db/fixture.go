@@ -0,0 +1,202 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarfloader"
+	"strings"
+)
+
+const (
+	fixtureRefKey     = "_ref"
+	fixtureRefPrefix  = "$"
+	defaultFixtureKey = "id"
+)
+
+/*
+ * Fixture is one table block of a fixture file. Files are a list of blocks,
+ * loaded in order:
+ *
+ *	- table: user
+ *	  rows:
+ *	    - _ref: alice
+ *	      name: alice
+ *	- table: order
+ *	  rows:
+ *	    - uid: $alice.id
+ *	      amount: 100
+ *
+ * "$name.column" is a column of an earlier row, where name is the row's _ref
+ * label or a table name for the last row loaded into that table. The id of
+ * a row without one is its insert id. "$$" escapes a literal "$".
+ */
+type Fixture struct {
+	Table string                   `yaml:"table" json:"table"`
+	Rows  []map[string]interface{} `yaml:"rows" json:"rows"`
+}
+
+type FixtureSet struct {
+	db     *Mysql
+	tables []string
+	refs   map[string]map[string]interface{}
+}
+
+/*
+ * LoadFixtures truncates the tables named in the files (yaml, json or toml,
+ * see dwarfloader.Load) and loads their rows in one tx.
+ */
+func (db *Mysql) LoadFixtures(ctx context.Context, paths ...string) (*FixtureSet, error) {
+	var fixtures []Fixture
+	for _, path := range paths {
+		var file []Fixture
+		if err := dwarfloader.Load(path, &file); err != nil {
+			return nil, fmt.Errorf("fixture %s: %v", path, err)
+		}
+		fixtures = append(fixtures, file...)
+	}
+
+	set := &FixtureSet{
+		db:   db,
+		refs: make(map[string]map[string]interface{}),
+	}
+
+	seen := make(map[string]bool)
+	for _, fixture := range fixtures {
+		if !seen[fixture.Table] {
+			seen[fixture.Table] = true
+			set.tables = append(set.tables, fixture.Table)
+		}
+	}
+
+	if err := set.Clean(ctx); err != nil {
+		return nil, err
+	}
+
+	err := db.inTx(ctx, func(tx *TxInstance) error {
+		for _, fixture := range fixtures {
+			for _, row := range fixture.Rows {
+				if err := set.insert(ctx, tx, fixture.Table, row); err != nil {
+					return fmt.Errorf("fixture %s: %v", fixture.Table, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+func LoadFixtures(ctx context.Context, paths ...string) (*FixtureSet, error) {
+	return mysql.LoadFixtures(ctx, paths...)
+}
+
+func (s *FixtureSet) insert(ctx context.Context, tx *TxInstance, table string, row map[string]interface{}) error {
+	data := make(map[string]interface{}, len(row))
+	var label string
+
+	for k, v := range row {
+		if k == fixtureRefKey {
+			label = fmt.Sprint(v)
+			continue
+		}
+
+		resolved, err := s.resolve(v)
+		if err != nil {
+			return err
+		}
+		data[k] = resolved
+	}
+
+	lastInsertId, err := tx.AddContext(ctx, table, data)
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		loaded[k] = v
+	}
+	if _, ok := loaded[defaultFixtureKey]; !ok {
+		loaded[defaultFixtureKey] = lastInsertId
+	}
+
+	s.refs[table] = loaded
+	if label != "" {
+		s.refs[label] = loaded
+	}
+
+	return nil
+}
+
+func (s *FixtureSet) resolve(v interface{}) (interface{}, error) {
+	str, ok := v.(string)
+	if !ok || !strings.HasPrefix(str, fixtureRefPrefix) {
+		return v, nil
+	}
+	if strings.HasPrefix(str, fixtureRefPrefix+fixtureRefPrefix) {
+		return str[1:], nil
+	}
+
+	parts := strings.SplitN(str[1:], ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("bad reference %q, want $name.column", str)
+	}
+
+	value, ok := s.Ref(parts[0], parts[1])
+	if !ok {
+		return nil, fmt.Errorf("unknown reference %q", str)
+	}
+	return value, nil
+}
+
+// Ref returns column of the row labelled name, or of the last row loaded into table name.
+func (s *FixtureSet) Ref(name string, column string) (interface{}, bool) {
+	row, ok := s.refs[name]
+	if !ok {
+		return nil, false
+	}
+
+	value, ok := row[column]
+	return value, ok
+}
+
+// Clean truncates the tables of the set, e.g. in a test teardown.
+func (s *FixtureSet) Clean(ctx context.Context) error {
+	return s.db.Truncate(ctx, s.tables...)
+}
+
+/*
+ * Truncate empties tables with foreign key checks off, so the order does not
+ * matter. TRUNCATE commits implicitly and cannot run inside a tx.
+ */
+func (db *Mysql) Truncate(ctx context.Context, tables ...string) error {
+	p, done := db.acquire()
+	defer done()
+
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return Classify(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS=0"); err != nil {
+		return Classify(err)
+	}
+	defer conn.ExecContext(context.Background(), "SET FOREIGN_KEY_CHECKS=1")
+
+	for _, table := range tables {
+		if _, err := conn.ExecContext(ctx, "TRUNCATE TABLE "+table); err != nil {
+			return Classify(err)
+		}
+		db.invalidate(table)
+	}
+
+	return nil
+}
+
+func Truncate(ctx context.Context, tables ...string) error {
+	return mysql.Truncate(ctx, tables...)
+}
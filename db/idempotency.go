@@ -0,0 +1,172 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"time"
+)
+
+const (
+	IdempotencyInProgress = 0
+	IdempotencyDone       = 1
+
+	defaultIdempotencyTTL = time.Hour * 24
+	idempotencyPurgeBatch = 1000
+)
+
+// IdempotencyTable is the table used by Idempotent.
+var IdempotencyTable = "db_idempotency"
+
+const idempotencySchema = "CREATE TABLE IF NOT EXISTS `%s` (" +
+	"`idempotency_key` VARCHAR(255) NOT NULL," +
+	"`request_hash` CHAR(64) NOT NULL," +
+	"`status` TINYINT NOT NULL DEFAULT 0," +
+	"`response` MEDIUMBLOB NULL," +
+	"`expires_at` DATETIME NOT NULL," +
+	"`created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+	"PRIMARY KEY (`idempotency_key`)," +
+	"KEY `idx_expires_at` (`expires_at`)" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+var (
+	ErrIdempotencyInProgress = errors.New("idempotency key in progress")
+	ErrIdempotencyMismatch   = errors.New("idempotency key reused with another request")
+)
+
+// InProgressError is returned for a key another tx holds, Err is the lock error that told so.
+type InProgressError struct {
+	Key string
+	Err error
+}
+
+func (e *InProgressError) Error() string {
+	return fmt.Sprintf("idempotency key %q in progress", e.Key)
+}
+
+func (e *InProgressError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InProgressError) Is(target error) bool {
+	return target == ErrIdempotencyInProgress
+}
+
+type idempotencyRecord struct {
+	RequestHash string `db:"request_hash"`
+	Status      int    `db:"status"`
+	Response    []byte `db:"response"`
+	Expired     int    `db:"expired"`
+}
+
+// CreateIdempotency creates IdempotencyTable if it does not exist.
+func (db *Mysql) CreateIdempotency() error {
+	_, err := db.Exec(fmt.Sprintf(idempotencySchema, IdempotencyTable))
+	return err
+}
+
+/*
+ * Idempotent
+ *
+ * Runs fn at most once per key within ttl (24h when <= 0), in the tx of the
+ * caller: the key is written with fn's writes and the response, so a
+ * rollback forgets it and a retry runs fn again. A repeat of a completed
+ * request returns the stored response with replayed set, without calling
+ * fn. A request under a key held by a running tx fails at once with
+ * *InProgressError; the tx must be rolled back then. A key reused with
+ * another request fails with ErrIdempotencyMismatch. Keys are global,
+ * prefix them with the client when clients pick them. Needs MySQL 8.0 for
+ * NOWAIT.
+ */
+func (i *TxInstance) Idempotent(key string, request []byte, ttl time.Duration, fn func() ([]byte, error)) (response []byte, replayed bool, err error) {
+	if i == nil || i.Tx == nil {
+		return nil, false, ErrNoTx
+	}
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+
+	sum := sha256.Sum256(request)
+	var requestHash string = hex.EncodeToString(sum[:])
+
+	// NOWAIT: a key inserted by a running tx is locked, fail instead of waiting for it
+	var sqlStr string = "SELECT `request_hash`,`status`,`response`,`expires_at`<=NOW() AS `expired` FROM " + IdempotencyTable +
+		" WHERE `idempotency_key`=? FOR UPDATE NOWAIT"
+
+	rows, err := i.Query(sqlStr, key)
+	if errors.Is(err, ErrLockNoWait) {
+		return nil, false, &InProgressError{Key: key, Err: err}
+	}
+	if err != nil {
+		dwarflog.Error(err, sqlStr, key)
+		return nil, false, err
+	}
+
+	var records []idempotencyRecord
+	scanErr := ScanStructs(rows, &records)
+	rows.Close()
+	if scanErr != nil {
+		return nil, false, scanErr
+	}
+
+	if len(records) > 0 {
+		record := records[0]
+		if record.Expired == 0 {
+			if record.RequestHash != requestHash {
+				return nil, false, ErrIdempotencyMismatch
+			}
+			if record.Status == IdempotencyDone {
+				return record.Response, true, nil
+			}
+			// left in progress by a tx committed without the response
+			return nil, false, &InProgressError{Key: key}
+		}
+
+		if _, err := i.Delete(IdempotencyTable, map[string]interface{}{"idempotency_key": key}); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// with no row to lock, two requests may both get here: the loser waits for the winner's tx, then fails
+	sqlStr = "INSERT INTO " + IdempotencyTable + " (`idempotency_key`,`request_hash`,`status`,`expires_at`) VALUES (?,?,?,NOW()+INTERVAL ? SECOND)"
+	if _, err := i.Exec(sqlStr, key, requestHash, IdempotencyInProgress, int64((ttl+time.Second-1)/time.Second)); err != nil {
+		if errors.Is(err, ErrDuplicate) || errors.Is(err, ErrDeadlock) || errors.Is(err, ErrLockWaitTimeout) {
+			return nil, false, &InProgressError{Key: key, Err: err}
+		}
+		dwarflog.Error(err, sqlStr, key)
+		return nil, false, err
+	}
+
+	response, err = fn()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if _, err := i.Update(IdempotencyTable, map[string]interface{}{
+		"status":   IdempotencyDone,
+		"response": response,
+	}, map[string]interface{}{"idempotency_key": key}); err != nil {
+		return nil, false, err
+	}
+
+	return response, false, nil
+}
+
+// PurgeIdempotency deletes the expired keys, in batches so it does not hold locks for long.
+func (db *Mysql) PurgeIdempotency() (int64, error) {
+	var total int64
+	for {
+		res, err := db.Exec("DELETE FROM "+IdempotencyTable+" WHERE `expires_at`<NOW() LIMIT ?", idempotencyPurgeBatch)
+		if err != nil {
+			return total, err
+		}
+
+		n, _ := res.RowsAffected()
+		total += n
+		if n < idempotencyPurgeBatch {
+			return total, nil
+		}
+	}
+}
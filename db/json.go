@@ -0,0 +1,159 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+/*
+ * JSON
+ *
+ * Column wrapper for the MySQL JSON type. V is marshaled on write, NULL when
+ * nil, and a scan unmarshals into V when it is a pointer, e.g.
+ * db.JSON{V: &settings}; otherwise V receives the decoded value
+ * (map[string]interface{}, []interface{}, float64, ...). The module still
+ * targets Go 1.16, so the type is held by V rather than a type parameter.
+ */
+type JSON struct {
+	V interface{}
+}
+
+func (j JSON) Value() (driver.Value, error) {
+	if j.V == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(j.V)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (j *JSON) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		if j.V != nil && reflect.TypeOf(j.V).Kind() == reflect.Ptr {
+			elem := reflect.ValueOf(j.V).Elem()
+			elem.Set(reflect.Zero(elem.Type()))
+		} else {
+			j.V = nil
+		}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into JSON", src)
+	}
+
+	if j.V != nil && reflect.TypeOf(j.V).Kind() == reflect.Ptr {
+		return json.Unmarshal(data, j.V)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	j.V = v
+	return nil
+}
+
+func (j JSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.V)
+}
+
+func (j *JSON) UnmarshalJSON(data []byte) error {
+	if j.V != nil && reflect.TypeOf(j.V).Kind() == reflect.Ptr {
+		return json.Unmarshal(data, j.V)
+	}
+	return json.Unmarshal(data, &j.V)
+}
+
+// conditionExpr is a condition value compiled to its own expression instead of `column`=?.
+type conditionExpr interface {
+	where(column string) (string, []interface{})
+}
+
+// updateExpr is an update value compiled to its own assignment instead of `column`=?.
+type updateExpr interface {
+	set(column string) (string, []interface{})
+}
+
+type jsonPath struct {
+	path  string
+	value interface{}
+}
+
+/*
+ * JSONPath matches documents whose value at path equals value, compared
+ * unquoted like column->>path:
+ *
+ *	db.Count("product", map[string]interface{}{"attrs": db.JSONPath("$.color", "red")})
+ */
+func JSONPath(path string, value interface{}) interface{} {
+	return jsonPath{path: path, value: value}
+}
+
+func (p jsonPath) where(column string) (string, []interface{}) {
+	// ->> only takes a literal path, this is its placeholder friendly form
+	return "JSON_UNQUOTE(JSON_EXTRACT(`" + column + "`,?))=?", []interface{}{p.path, p.value}
+}
+
+type jsonContains struct {
+	value interface{}
+	path  string
+}
+
+/*
+ * JSONContains matches documents containing value, as a whole or at path,
+ * e.g. JSONContains([]string{"sale"}) on a tags array.
+ */
+func JSONContains(value interface{}, path ...string) interface{} {
+	c := jsonContains{value: value}
+	if len(path) > 0 {
+		c.path = path[0]
+	}
+	return c
+}
+
+func (c jsonContains) where(column string) (string, []interface{}) {
+	// marshaled by JSON.Value, so an invalid value fails the statement
+	if c.path == "" {
+		return "JSON_CONTAINS(`" + column + "`,?)", []interface{}{JSON{V: c.value}}
+	}
+	return "JSON_CONTAINS(`" + column + "`,?,?)", []interface{}{JSON{V: c.value}, c.path}
+}
+
+type jsonSet map[string]interface{}
+
+/*
+ * JSONSet updates only the given paths of a JSON column, creating the
+ * document when it is NULL. Like JSON_SET, missing parent paths are not
+ * created:
+ *
+ *	db.Update("product", map[string]interface{}{
+ *		"attrs": db.JSONSet(map[string]interface{}{"$.color": "red", "$.stock": 42}),
+ *	}, map[string]interface{}{"id": 1})
+ */
+func JSONSet(paths map[string]interface{}) interface{} {
+	return jsonSet(paths)
+}
+
+func (s jsonSet) set(column string) (string, []interface{}) {
+	var placeHolders []string
+	var args []interface{}
+
+	for _, path := range sortedKeys(s) {
+		// CAST keeps the JSON type of the value, a plain ? would set a string
+		placeHolders = append(placeHolders, "?,CAST(? AS JSON)")
+		args = append(args, path, JSON{V: s[path]})
+	}
+
+	return "`" + column + "`=JSON_SET(COALESCE(`" + column + "`,JSON_OBJECT())," + strings.Join(placeHolders, ",") + ")", args
+}
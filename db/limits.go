@@ -0,0 +1,367 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerErrorRate   = 0.5
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = time.Second * 10
+	defaultBreakerCooldown    = time.Second * 5
+	defaultBreakerProbes      = 1
+)
+
+var (
+	ErrTooManyRows = errors.New("result exceeds max rows")
+	ErrTableBusy   = errors.New("table concurrency limit reached")
+	ErrCircuitOpen = errors.New("db circuit open")
+)
+
+/*
+ * Limits
+ *
+ * Timeout bounds every statement: its context gets the deadline and SELECTs
+ * carry a MAX_EXECUTION_TIME hint, so the server stops them too. For Query
+ * the deadline also covers reading the rows. MaxRows fails the helpers that
+ * scan into a dest (CachedQuery, Paginate, SelectForUpdate, ...) with
+ * ErrTooManyRows; *sql.Rows from Query are not counted. TableConcurrency
+ * caps the statements running at once on a table, for the helpers that take
+ * a table name; a statement waits up to Timeout for a slot, then fails with
+ * ErrTableBusy. Zero means no limit.
+ */
+type Limits struct {
+	Timeout          time.Duration
+	MaxRows          int
+	TableConcurrency int
+}
+
+func (db *Mysql) SetLimits(limits Limits) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.limits = limits
+	db.slots = make(map[string]chan struct{})
+}
+
+// currentLimits reads the limits, SetLimits may change them on a live instance.
+func (db *Mysql) currentLimits() Limits {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.limits
+}
+
+func SetLimits(limits Limits) {
+	mysql.SetLimits(limits)
+}
+
+/*
+ * BreakerConfig
+ *
+ * The breaker opens when at least MinRequests statements ran in the last
+ * Window and ErrorRate of them failed with a connection, timeout or
+ * overload error. Open, it fails every statement with *CircuitOpenError for
+ * Cooldown, then lets Probes statements through: it closes when they all
+ * succeed and opens again on the first failure.
+ */
+type BreakerConfig struct {
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	Cooldown    time.Duration
+	Probes      int
+}
+
+type CircuitOpenError struct {
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("db circuit open, retry at %s", e.RetryAt.Format(time.RFC3339))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breaker struct {
+	config BreakerConfig
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int // in flight while half open
+	successes   int // of the probes
+}
+
+// SetBreaker turns the circuit breaker on, zero fields take the defaults.
+func (db *Mysql) SetBreaker(config BreakerConfig) {
+	if config.ErrorRate <= 0 {
+		config.ErrorRate = defaultBreakerErrorRate
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultBreakerMinRequests
+	}
+	if config.Window <= 0 {
+		config.Window = defaultBreakerWindow
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = defaultBreakerCooldown
+	}
+	if config.Probes <= 0 {
+		config.Probes = defaultBreakerProbes
+	}
+
+	db.mu.Lock()
+	db.breaker = &breaker{config: config}
+	db.mu.Unlock()
+}
+
+func SetBreaker(config BreakerConfig) {
+	mysql.SetBreaker(config)
+}
+
+// allow reports whether a statement may run, and whether it is a half open probe.
+func (b *breaker) allow(now time.Time) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		retryAt := b.openedAt.Add(b.config.Cooldown)
+		if now.Before(retryAt) {
+			return false, &CircuitOpenError{RetryAt: retryAt}
+		}
+		b.state = breakerHalfOpen
+		b.probes, b.successes = 0, 0
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.probes+b.successes >= b.config.Probes {
+			return false, &CircuitOpenError{RetryAt: now.Add(b.config.Cooldown)}
+		}
+		b.probes++
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (b *breaker) record(now time.Time, probe bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		if b.state != breakerHalfOpen {
+			return
+		}
+		b.probes--
+		if failed {
+			b.open(now)
+			return
+		}
+		if b.successes++; b.successes >= b.config.Probes {
+			b.state = breakerClosed
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		return
+	}
+
+	if b.state != breakerClosed {
+		return
+	}
+
+	if now.Sub(b.windowStart) > b.config.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+
+	if b.requests >= b.config.MinRequests && float64(b.failures) >= b.config.ErrorRate*float64(b.requests) {
+		b.open(now)
+	}
+}
+
+// abort gives back the slot of a probe that did not run.
+func (b *breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+}
+
+// breakerFailure reports errors telling the database is down or overloaded, not the statement is wrong.
+func breakerFailure(err error) bool {
+	err = Classify(err)
+	return errors.Is(err, ErrConnLost) || errors.Is(err, ErrQueryTimeout) || errors.Is(err, ErrTooManyConns) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// statement is a statement admitted by guard.
+type statement struct {
+	ctx     context.Context
+	query   string
+	cancel  context.CancelFunc
+	breaker *breaker
+	slot    chan struct{}
+	probe   bool
+}
+
+/*
+ * guard admits a statement on table ("" for raw SQL) through the breaker and
+ * the table limit, and bounds it by Limits.Timeout. The statement must be
+ * ended with finish, or release when its rows outlive the call.
+ */
+func (db *Mysql) guard(ctx context.Context, table string, query string) (*statement, error) {
+	st := &statement{ctx: ctx, query: query}
+	if db == nil {
+		return st, nil
+	}
+
+	db.mu.RLock()
+	limits := db.limits
+	st.breaker = db.breaker
+	db.mu.RUnlock()
+
+	if st.breaker != nil {
+		probe, err := st.breaker.allow(time.Now())
+		if err != nil {
+			return nil, err
+		}
+		st.probe = probe
+	}
+
+	if table != "" && limits.TableConcurrency > 0 {
+		slot, err := db.tableSlot(ctx, table, limits)
+		if err != nil {
+			if st.probe {
+				st.breaker.abort()
+			}
+			return nil, err
+		}
+		st.slot = slot
+	}
+
+	if timeout := limits.Timeout; timeout > 0 {
+		st.ctx, st.cancel = context.WithTimeout(ctx, timeout)
+		st.query = maxExecutionTime(query, timeout)
+	}
+
+	return st, nil
+}
+
+func (db *Mysql) tableSlot(ctx context.Context, table string, limits Limits) (chan struct{}, error) {
+	db.mu.Lock()
+	slot, ok := db.slots[table]
+	if !ok {
+		slot = make(chan struct{}, limits.TableConcurrency)
+		db.slots[table] = slot
+	}
+	db.mu.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return slot, nil
+	default:
+	}
+
+	var wait <-chan time.Time
+	if limits.Timeout > 0 {
+		timer := time.NewTimer(limits.Timeout)
+		defer timer.Stop()
+		wait = timer.C
+	}
+
+	select {
+	case slot <- struct{}{}:
+		return slot, nil
+	case <-wait:
+		return nil, ErrTableBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// maxExecutionTime hints SELECTs with the timeout, which the server enforces for read only statements.
+func maxExecutionTime(query string, timeout time.Duration) string {
+	trimmed := strings.TrimLeft(query, " \t\r\n(")
+	if len(trimmed) < 6 || !strings.EqualFold(trimmed[:6], "SELECT") || strings.Contains(query, "MAX_EXECUTION_TIME") {
+		return query
+	}
+
+	var ms int64 = int64((timeout + time.Millisecond - 1) / time.Millisecond)
+	at := len(query) - len(trimmed) + 6
+
+	return query[:at] + fmt.Sprintf(" /*+ MAX_EXECUTION_TIME(%d) */", ms) + query[at:]
+}
+
+func (st *statement) record(err error) {
+	if st.breaker != nil {
+		st.breaker.record(time.Now(), st.probe, breakerFailure(err))
+	}
+}
+
+// release records the outcome and frees the table slot, the context lives on until its deadline.
+func (st *statement) release(err error) {
+	st.record(err)
+	if st.slot != nil {
+		<-st.slot
+		st.slot = nil
+	}
+}
+
+func (st *statement) finish(err error) {
+	st.release(err)
+	if st.cancel != nil {
+		st.cancel()
+	}
+}
+
+var closedDone = make(chan struct{})
+
+func init() {
+	close(closedDone)
+}
+
+// failedContext is done with err, it hands a guard error out through a *sql.Row without touching the database.
+type failedContext struct {
+	context.Context
+	err error
+}
+
+func errorContext(err error) context.Context {
+	return failedContext{Context: context.Background(), err: err}
+}
+
+func (c failedContext) Done() <-chan struct{} {
+	return closedDone
+}
+
+func (c failedContext) Err() error {
+	return c.err
+}
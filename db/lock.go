@@ -0,0 +1,78 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/MangoMilk/go-lib/dwarflog"
+)
+
+type LockWait string
+
+const (
+	LockWaitDefault = LockWait("")
+	LockNoWait      = LockWait("NOWAIT")      // fail with ErrLockNoWait if a row is locked
+	LockSkipLocked  = LockWait("SKIP LOCKED") // leave locked rows out of the result
+)
+
+/*
+ * SelectForUpdate
+ *
+ * SELECT ... FOR UPDATE, scanning the locked rows into dest (see ScanStructs).
+ * The locks are held until the tx commits or rolls back, outside a tx it
+ * fails with ErrNoTx. NOWAIT and SKIP LOCKED need MySQL 8.0.
+ */
+func (i *TxInstance) SelectForUpdate(dest interface{}, table string, condition map[string]interface{}, wait LockWait) error {
+	return i.selectLock(dest, table, condition, "FOR UPDATE", wait)
+}
+
+/*
+ * SelectForShare is SelectForUpdate with a shared lock: other txs may read
+ * the rows but not change them.
+ */
+func (i *TxInstance) SelectForShare(dest interface{}, table string, condition map[string]interface{}, wait LockWait) error {
+	// LOCK IN SHARE MODE keeps 5.7 working, FOR SHARE is needed for the wait options
+	var lock string = "LOCK IN SHARE MODE"
+	if wait != LockWaitDefault {
+		lock = "FOR SHARE"
+	}
+
+	return i.selectLock(dest, table, condition, lock, wait)
+}
+
+func (i *TxInstance) selectLock(dest interface{}, table string, condition map[string]interface{}, lock string, wait LockWait) (err error) {
+	if i == nil || i.Tx == nil {
+		return ErrNoTx
+	}
+
+	condition, err = i.db.prepareCondition(i.txContext(), table, condition)
+	if err != nil {
+		return err
+	}
+
+	sqlStr, args := buildSelect("*", table, condition)
+	sqlStr += " " + lock
+	if wait != LockWaitDefault {
+		sqlStr += " " + string(wait)
+	}
+
+	i.db.explain(i.txContext(), sqlStr, args)
+
+	st, err := i.db.guard(i.txContext(), table, sqlStr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		st.finish(err)
+	}()
+
+	rows, err := i.Tx.QueryContext(st.ctx, st.query, args...)
+	if err == sql.ErrTxDone {
+		return ErrNoTx
+	}
+	if err != nil {
+		dwarflog.Error(err, sqlStr, args)
+		return Classify(err)
+	}
+	defer rows.Close()
+
+	return scanStructs(rows, dest, i.db.currentLimits().MaxRows, table, i.db.encrypted[table])
+}
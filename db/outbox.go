@@ -0,0 +1,232 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"time"
+)
+
+const (
+	OutboxPending   = 0
+	OutboxDelivered = 1
+	OutboxDead      = 2 // gave up after MaxAttempts
+
+	defaultOutboxInterval    = time.Second
+	defaultOutboxBatchSize   = 100
+	defaultOutboxMaxAttempts = 10
+	maxOutboxBackoff         = time.Minute * 10
+	maxOutboxError           = 1024 // characters of last_error
+)
+
+// OutboxTable is the table used by Enqueue and OutboxRelay.
+var OutboxTable = "db_outbox"
+
+const outboxSchema = "CREATE TABLE IF NOT EXISTS `%s` (" +
+	"`id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT," +
+	"`topic` VARCHAR(255) NOT NULL," +
+	"`payload` MEDIUMBLOB NOT NULL," +
+	"`status` TINYINT NOT NULL DEFAULT 0," +
+	"`attempts` INT NOT NULL DEFAULT 0," +
+	"`last_error` VARCHAR(1024) NOT NULL DEFAULT ''," +
+	"`next_attempt_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+	"`created_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+	"`delivered_at` DATETIME NULL," +
+	"PRIMARY KEY (`id`)," +
+	"KEY `idx_status_next` (`status`, `next_attempt_at`)" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+type OutboxMessage struct {
+	Id       int64  `db:"id"`
+	Topic    string `db:"topic"`
+	Payload  []byte `db:"payload"`
+	Attempts int    `db:"attempts"`
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, msg OutboxMessage) error
+}
+
+type PublisherFunc func(ctx context.Context, msg OutboxMessage) error
+
+func (f PublisherFunc) Publish(ctx context.Context, msg OutboxMessage) error {
+	return f(ctx, msg)
+}
+
+// CreateOutbox creates OutboxTable if it does not exist.
+func (db *Mysql) CreateOutbox() error {
+	_, err := db.Exec(fmt.Sprintf(outboxSchema, OutboxTable))
+	return err
+}
+
+/*
+ * Enqueue writes an event in the same tx as the business rows, so it is
+ * published if and only if the tx commits.
+ */
+func (i *TxInstance) Enqueue(topic string, payload []byte) (int64, error) {
+	return i.Add(OutboxTable, map[string]interface{}{
+		"topic":   topic,
+		"payload": payload,
+	})
+}
+
+/*
+ * OutboxRelay
+ *
+ * Polls pending events with FOR UPDATE SKIP LOCKED, so several relays can run
+ * side by side, and publishes them in id order. A failed publish is retried
+ * after Backoff(attempts) until MaxAttempts, then the event is marked dead.
+ *
+ * Delivery is at least once: a crash between Publish and the commit replays
+ * the event, consumers should dedupe on OutboxMessage.Id.
+ */
+type OutboxRelay struct {
+	db          *Mysql
+	publisher   Publisher
+	Interval    time.Duration // default 1s when <= 0
+	BatchSize   int           // default 100 when <= 0
+	MaxAttempts int
+	Backoff     func(attempts int) time.Duration
+}
+
+func NewOutboxRelay(db *Mysql, publisher Publisher) *OutboxRelay {
+	return &OutboxRelay{
+		db:          db,
+		publisher:   publisher,
+		Interval:    defaultOutboxInterval,
+		BatchSize:   defaultOutboxBatchSize,
+		MaxAttempts: defaultOutboxMaxAttempts,
+		Backoff:     outboxBackoff,
+	}
+}
+
+// outboxBackoff doubles from 1s up to 10m.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 10 {
+		return maxOutboxBackoff
+	}
+
+	backoff := time.Second << uint(attempts)
+	if backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+	return backoff
+}
+
+func (r *OutboxRelay) interval() time.Duration {
+	if r.Interval <= 0 {
+		return defaultOutboxInterval
+	}
+	return r.Interval
+}
+
+func (r *OutboxRelay) batchSize() int {
+	if r.BatchSize <= 0 {
+		return defaultOutboxBatchSize
+	}
+	return r.BatchSize
+}
+
+// Run polls until ctx is done.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+
+	for {
+		n, err := r.Poll(ctx)
+		if err != nil {
+			dwarflog.Error(err, "outbox relay")
+		}
+
+		// keep draining while batches are full
+		if err == nil && n >= r.batchSize() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll handles one batch and returns the number of events it took.
+func (r *OutboxRelay) Poll(ctx context.Context) (int, error) {
+	i, err := r.db.BeginTxContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx := i.Tx
+
+	var sqlStr string = "SELECT `id`,`topic`,`payload`,`attempts` FROM " + OutboxTable +
+		" WHERE `status`=? AND `next_attempt_at`<=NOW() ORDER BY `id` LIMIT ? FOR UPDATE SKIP LOCKED"
+
+	rows, err := tx.QueryContext(ctx, sqlStr, OutboxPending, r.batchSize())
+	if err != nil {
+		dwarflog.Error(err, sqlStr)
+		i.Rollback()
+		return 0, Classify(err)
+	}
+
+	var msgs []OutboxMessage
+	scanErr := ScanStructs(rows, &msgs)
+	rows.Close()
+	if scanErr != nil {
+		i.Rollback()
+		return 0, scanErr
+	}
+
+	for _, msg := range msgs {
+		if markErr := r.deliver(ctx, i, msg); markErr != nil {
+			i.Rollback()
+			return 0, markErr
+		}
+	}
+
+	return len(msgs), i.Commit()
+}
+
+func (r *OutboxRelay) deliver(ctx context.Context, i *TxInstance, msg OutboxMessage) error {
+	condition := map[string]interface{}{"id": msg.Id}
+
+	publishErr := r.publisher.Publish(ctx, msg)
+	if publishErr == nil {
+		_, err := i.Exec("UPDATE "+OutboxTable+" SET `status`=?,`attempts`=`attempts`+1,`delivered_at`=NOW() WHERE `id`=?", OutboxDelivered, msg.Id)
+		return err
+	}
+
+	var attempts int = msg.Attempts + 1
+	// by characters: a split multi-byte one fails the update, and the batch with it
+	var lastError string = publishErr.Error()
+	if runes := []rune(lastError); len(runes) > maxOutboxError {
+		lastError = string(runes[:maxOutboxError])
+	}
+
+	if attempts >= r.MaxAttempts {
+		dwarflog.Error(publishErr, "outbox event dead", msg.Id, msg.Topic)
+		_, err := i.Update(OutboxTable, map[string]interface{}{
+			"status":     OutboxDead,
+			"attempts":   attempts,
+			"last_error": lastError,
+		}, condition)
+		return err
+	}
+
+	_, err := i.Exec("UPDATE "+OutboxTable+" SET `attempts`=?,`last_error`=?,`next_attempt_at`=NOW()+INTERVAL ? SECOND WHERE `id`=?",
+		attempts, lastError, int64(r.Backoff(attempts).Seconds()), msg.Id)
+	return err
+}
+
+// PurgeDelivered deletes events delivered more than olderThan ago.
+func (r *OutboxRelay) PurgeDelivered(olderThan time.Duration) (int64, error) {
+	res, err := r.db.Exec("DELETE FROM "+OutboxTable+" WHERE `status`=? AND `delivered_at`<NOW()-INTERVAL ? SECOND", OutboxDelivered, int64(olderThan.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
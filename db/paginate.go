@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"reflect"
+)
+
+const defaultPageSize = 20
+
+type PageQuery struct {
+	Table     string
+	Columns   []string               // empty means all columns
+	Condition map[string]interface{} // same equality conditions as Update and Delete
+	Key       string                 // integer sort and keyset column, default "id"
+	Desc      bool
+	Total     bool // PaginateAfter only: also count the matching rows, Paginate always does
+}
+
+type Page struct {
+	Page    int // 1 based, 0 in keyset mode
+	Size    int
+	Total   int64 // 0 in keyset mode unless PageQuery.Total
+	Pages   int64
+	HasNext bool
+	Cursor  int64 // key of the last row, for PaginateAfter
+}
+
+func (q PageQuery) key() string {
+	if q.Key == "" {
+		return defaultChunkKey
+	}
+	return q.Key
+}
+
+func (q PageQuery) order() string {
+	if q.Desc {
+		return " ORDER BY `" + q.key() + "` DESC"
+	}
+	return " ORDER BY `" + q.key() + "`"
+}
+
+func newPage(page int, size int, total int64) Page {
+	var pages int64 = (total + int64(size) - 1) / int64(size)
+
+	return Page{
+		Page:    page,
+		Size:    size,
+		Total:   total,
+		Pages:   pages,
+		HasNext: int64(page) < pages,
+	}
+}
+
+/*
+ * Paginate scans page (from 1) of size rows into dest (see ScanStructs) and
+ * counts the matching rows. OFFSET gets slow on deep pages, use
+ * PaginateAfter there.
+ */
+func (db *Mysql) Paginate(query PageQuery, page int, size int, dest interface{}) (Page, error) {
+	return db.PaginateContext(context.Background(), query, page, size, dest)
+}
+
+func (db *Mysql) PaginateContext(ctx context.Context, query PageQuery, page int, size int, dest interface{}) (Page, error) {
+	if page < 1 {
+		page = 1
+	}
+	if size <= 0 {
+		size = defaultPageSize
+	}
+
+	condition, err := db.prepareCondition(ctx, query.Table, query.Condition)
+	if err != nil {
+		return Page{}, err
+	}
+
+	p, done := db.acquire()
+	total, err := count(ctx, db, p.db, query.Table, query.Condition)
+	done()
+	if err != nil {
+		return Page{}, err
+	}
+
+	sqlStr, args := buildSelect(selectFields(query.Columns), query.Table, condition)
+	sqlStr += query.order() + " LIMIT ? OFFSET ?"
+	args = append(args, size, (page-1)*size)
+
+	if err := db.scanQueryContext(ctx, query.Table, dest, sqlStr, args...); err != nil {
+		return Page{}, err
+	}
+
+	result := newPage(page, size, total)
+	// the key may not be selected, the cursor is optional here
+	result.Cursor, _ = lastCursor(dest, query.key())
+
+	return result, nil
+}
+
+/*
+ * PaginateAfter is keyset pagination: it scans the size rows following
+ * cursor in key order, so deep pages cost the same as the first one. Pass 0
+ * for the first page, in either order, and Page.Cursor for the next ones.
+ * The matching rows are counted only with PageQuery.Total, a COUNT(*) on
+ * every page would cost what keyset pagination saves.
+ */
+func (db *Mysql) PaginateAfter(query PageQuery, cursor int64, size int, dest interface{}) (Page, error) {
+	return db.PaginateAfterContext(context.Background(), query, cursor, size, dest)
+}
+
+func (db *Mysql) PaginateAfterContext(ctx context.Context, query PageQuery, cursor int64, size int, dest interface{}) (Page, error) {
+	if size <= 0 {
+		size = defaultPageSize
+	}
+
+	condition, err := db.prepareCondition(ctx, query.Table, query.Condition)
+	if err != nil {
+		return Page{}, err
+	}
+
+	var total int64
+	if query.Total {
+		p, done := db.acquire()
+		total, err = count(ctx, db, p.db, query.Table, query.Condition)
+		done()
+		if err != nil {
+			return Page{}, err
+		}
+	}
+
+	conditionStr, args := whereClause(condition)
+	if cursor != 0 {
+		// 0 is no cursor: the first page
+		var compare string = ">"
+		if query.Desc {
+			compare = "<"
+		}
+		if conditionStr != "" {
+			conditionStr += " AND "
+		}
+		conditionStr += "`" + query.key() + "`" + compare + "?"
+		args = append(args, cursor)
+	}
+
+	var sqlStr string = "SELECT " + selectFields(query.Columns) + " FROM " + query.Table
+	if conditionStr != "" {
+		sqlStr += " WHERE " + conditionStr
+	}
+	sqlStr += query.order() + " LIMIT ?"
+	// one extra row tells whether there is a next page
+	args = append(args, size+1)
+
+	if err := db.scanQueryContext(ctx, query.Table, dest, sqlStr, args...); err != nil {
+		return Page{}, err
+	}
+
+	result := newPage(0, size, total)
+
+	rows := reflect.ValueOf(dest).Elem()
+	result.HasNext = rows.Len() > size
+	if result.HasNext {
+		rows.Set(rows.Slice(0, size))
+	}
+
+	result.Cursor, err = lastCursor(dest, query.key())
+	if err == nil && rows.Len() == 0 {
+		result.Cursor = cursor
+	}
+
+	return result, err
+}
+
+func Paginate(query PageQuery, page int, size int, dest interface{}) (Page, error) {
+	return mysql.Paginate(query, page, size, dest)
+}
+
+func PaginateAfter(query PageQuery, cursor int64, size int, dest interface{}) (Page, error) {
+	return mysql.PaginateAfter(query, cursor, size, dest)
+}
+
+func PaginateContext(ctx context.Context, query PageQuery, page int, size int, dest interface{}) (Page, error) {
+	return mysql.PaginateContext(ctx, query, page, size, dest)
+}
+
+func PaginateAfterContext(ctx context.Context, query PageQuery, cursor int64, size int, dest interface{}) (Page, error) {
+	return mysql.PaginateAfterContext(ctx, query, cursor, size, dest)
+}
+
+func lastCursor(dest interface{}, key string) (int64, error) {
+	rows := reflect.ValueOf(dest).Elem()
+	if rows.Len() == 0 {
+		return 0, nil
+	}
+
+	return chunkCursor(rows.Index(rows.Len()-1), key)
+}
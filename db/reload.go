@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/MangoMilk/go-lib/dwarfloader"
+	"github.com/MangoMilk/go-lib/dwarflog"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// ReloadDrainTimeout bounds the wait for the old pool's txs and advisory locks, it is closed under them afterwards.
+	ReloadDrainTimeout = time.Minute
+
+	ErrNotSetup = errors.New("db is not set up")
+)
+
+// pool is one generation of connections, replaced as a whole by Reload.
+type pool struct {
+	db    *sql.DB
+	stmts *stmtCache
+	inUse sync.WaitGroup // statements and txs running on db
+}
+
+func newPool(config MysqlConfig) (*pool, error) {
+	// gen config
+	var dsn string = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4", config.User, config.Password, config.Host, config.Port, config.Database)
+
+	// check config
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// set conn config
+	db.SetConnMaxLifetime(time.Minute * 3) // set client max life time less than mysql param "wait_timeout"
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+
+	var stmts *stmtCache
+	if config.StmtCacheSize == 0 {
+		stmts = newStmtCache(defaultStmtCacheSize)
+	} else if config.StmtCacheSize > 0 {
+		stmts = newStmtCache(config.StmtCacheSize)
+	}
+
+	return &pool{db: db, stmts: stmts}, nil
+}
+
+func (p *pool) close() error {
+	if p.stmts != nil {
+		p.stmts.close()
+	}
+	return p.db.Close()
+}
+
+// acquire pins the current pool until release, Reload waits for it before closing the pool.
+func (db *Mysql) acquire() (*pool, func()) {
+	db.mu.RLock()
+	p := db.pool
+	p.inUse.Add(1)
+	db.mu.RUnlock()
+
+	return p, p.inUse.Done
+}
+
+// DB returns the current connection pool.
+func (db *Mysql) DB() *sql.DB {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.pool.db
+}
+
+/*
+ * Reload
+ *
+ * Moves db to a new pool for config, e.g. after a password rotation or a
+ * primary failover. Statements and txs started afterwards use the new pool;
+ * the old one is closed once its running txs and advisory locks end, or
+ * after ReloadDrainTimeout. Cache, tracer and table settings are kept. On error
+ * the old pool stays in use.
+ */
+func (db *Mysql) Reload(config MysqlConfig) error {
+	next, err := newPool(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if err := next.db.PingContext(ctx); err != nil {
+		next.close()
+		return Classify(err)
+	}
+
+	return db.replace(next)
+}
+
+// replace switches to next, then waits for the old pool to drain and closes it.
+func (db *Mysql) replace(next *pool) error {
+	db.mu.Lock()
+	old := db.pool
+	db.pool = next
+	db.Instance = next.db
+	db.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		old.inUse.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(ReloadDrainTimeout):
+		dwarflog.Error(errors.New("reload drain timeout"), "closing the old pool with txs still open")
+	}
+
+	return old.close()
+}
+
+// Reload reloads the instance of Setup with configs[0].
+func Reload(configs []MysqlConfig) error {
+	if mysql == nil {
+		return ErrNotSetup
+	}
+	return mysql.Reload(configs[0])
+}
+
+/*
+ * WatchConfig reloads the instance of Setup whenever the configs read from
+ * path by load change. The file is checked every interval until ctx is
+ * done. A nil load reads the file as a list of MysqlConfig, in any format
+ * dwarfloader.Load supports.
+ */
+func WatchConfig(ctx context.Context, path string, interval time.Duration, load func(path string) ([]MysqlConfig, error)) error {
+	if load == nil {
+		load = func(path string) ([]MysqlConfig, error) {
+			var configs []MysqlConfig
+			err := dwarfloader.Load(path, &configs)
+			return configs, err
+		}
+	}
+
+	var modTime time.Time
+	var current []MysqlConfig
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+		current, _ = load(path)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+
+		configs, err := load(path)
+		if err == nil && len(configs) == 0 {
+			err = errors.New("no db config")
+		}
+		if err != nil {
+			dwarflog.Error(err, "reload config", path)
+			continue
+		}
+		if reflect.DeepEqual(configs, current) {
+			continue
+		}
+
+		if err := Reload(configs); err != nil {
+			dwarflog.Error(err, "reload db", path)
+			continue
+		}
+		current = configs
+	}
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+var ErrScanDest = errors.New("scan dest must be a pointer to a slice of struct")
+
+/*
+ * ScanStructs scans every row into dest, which must be a pointer to a slice of
+ * struct or of struct pointers. Columns match the `db` tag of a field, or the
+ * field name when no tag is set. Unknown columns are discarded.
+ */
+func ScanStructs(rows *sql.Rows, dest interface{}) error {
+	return scanStructs(rows, dest, 0, "", nil)
+}
+
+// scanStructs fails with ErrTooManyRows past maxRows rows, 0 means no limit. The Encrypted
+// fields of the encrypted columns of table (see EncryptColumn) are opened with DecryptFor.
+func scanStructs(rows *sql.Rows, dest interface{}, maxRows int, table string, encrypted map[string]string) error {
+	sliceVal := reflect.ValueOf(dest)
+	if sliceVal.Kind() != reflect.Ptr || sliceVal.Elem().Kind() != reflect.Slice {
+		return ErrScanDest
+	}
+	sliceVal = sliceVal.Elem()
+
+	elemType := sliceVal.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return ErrScanDest
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	fields := structFields(elemType)
+	sliceVal.Set(sliceVal.Slice(0, 0))
+
+	for rows.Next() {
+		if maxRows > 0 && sliceVal.Len() >= maxRows {
+			return ErrTooManyRows
+		}
+
+		elem := reflect.New(elemType)
+		targets := make([]interface{}, len(columns))
+		for i, column := range columns {
+			if index, ok := fields[strings.ToLower(column)]; ok {
+				targets[i] = elem.Elem().Field(index).Addr().Interface()
+				if _, sealed := encrypted[column]; sealed {
+					if field, ok := targets[i].(*Encrypted); ok {
+						targets[i] = columnScanner{field: field, table: table, column: column}
+					}
+				}
+			} else {
+				targets[i] = new(interface{})
+			}
+		}
+
+		if scanErr := rows.Scan(targets...); scanErr != nil {
+			return scanErr
+		}
+
+		if isPtr {
+			sliceVal.Set(reflect.Append(sliceVal, elem))
+		} else {
+			sliceVal.Set(reflect.Append(sliceVal, elem.Elem()))
+		}
+	}
+
+	return rows.Err()
+}
+
+// structFields maps lower-cased column names to exported field indexes.
+func structFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		column := field.Tag.Get("db")
+		if column == "-" {
+			continue
+		}
+		if column == "" {
+			column = field.Name
+		}
+		fields[strings.ToLower(column)] = i
+	}
+
+	return fields
+}
+
+// structColumn returns the field of struct value v bound to column.
+func structColumn(v reflect.Value, column string) (reflect.Value, bool) {
+	v = reflect.Indirect(v)
+	index, ok := structFields(v.Type())[strings.ToLower(column)]
+	if !ok {
+		return reflect.Value{}, false
+	}
+
+	return v.Field(index), true
+}
+
+// ScanMaps scans every row into a column to value map, []byte values become strings.
+func ScanMaps(rows *sql.Rows) ([]map[string]interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []map[string]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		targets := make([]interface{}, len(columns))
+		for i := range values {
+			targets[i] = &values[i]
+		}
+
+		if scanErr := rows.Scan(targets...); scanErr != nil {
+			return nil, scanErr
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"database/sql"
+)
+
+type Column struct {
+	Table      string         `db:"table_name"`
+	Name       string         `db:"column_name"`
+	Position   int            `db:"ordinal_position"`
+	Default    sql.NullString `db:"column_default"`
+	IsNullable string         `db:"is_nullable"`
+	DataType   string         `db:"data_type"`   // e.g. varchar
+	ColumnType string         `db:"column_type"` // e.g. varchar(64), int unsigned
+	Key        string         `db:"column_key"`  // PRI, UNI, MUL or empty
+	Extra      string         `db:"extra"`       // e.g. auto_increment
+	Comment    string         `db:"column_comment"`
+}
+
+func (c Column) Nullable() bool {
+	return c.IsNullable == "YES"
+}
+
+type Index struct {
+	Name    string
+	Unique  bool
+	Columns []string // in index order
+}
+
+type indexColumn struct {
+	Table     string `db:"table_name"`
+	Name      string `db:"index_name"`
+	NonUnique int    `db:"non_unique"`
+	Column    string `db:"column_name"`
+}
+
+type Table struct {
+	Name    string `db:"table_name"`
+	Comment string `db:"table_comment"`
+	Columns []Column
+	Indexes []Index
+}
+
+/*
+ * Tables reads the base tables of database from information_schema, with
+ * columns in ordinal order and indexes in name order.
+ */
+func (db *Mysql) Tables(database string) ([]Table, error) {
+	var tables []Table
+	if err := db.scanQuery("", &tables, "SELECT TABLE_NAME AS table_name, TABLE_COMMENT AS table_comment FROM information_schema.TABLES"+
+		" WHERE TABLE_SCHEMA=? AND TABLE_TYPE='BASE TABLE' ORDER BY TABLE_NAME", database); err != nil {
+		return nil, err
+	}
+
+	var columns []Column
+	if err := db.scanQuery("", &columns, "SELECT TABLE_NAME AS table_name, COLUMN_NAME AS column_name, ORDINAL_POSITION AS ordinal_position,"+
+		" COLUMN_DEFAULT AS column_default, IS_NULLABLE AS is_nullable, DATA_TYPE AS data_type, COLUMN_TYPE AS column_type,"+
+		" COLUMN_KEY AS column_key, EXTRA AS extra, COLUMN_COMMENT AS column_comment FROM information_schema.COLUMNS"+
+		" WHERE TABLE_SCHEMA=? ORDER BY TABLE_NAME, ORDINAL_POSITION", database); err != nil {
+		return nil, err
+	}
+
+	var indexColumns []indexColumn
+	if err := db.scanQuery("", &indexColumns, "SELECT TABLE_NAME AS table_name, INDEX_NAME AS index_name, NON_UNIQUE AS non_unique,"+
+		" COLUMN_NAME AS column_name FROM information_schema.STATISTICS"+
+		" WHERE TABLE_SCHEMA=? ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX", database); err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*Table, len(tables))
+	for i := range tables {
+		byName[tables[i].Name] = &tables[i]
+	}
+
+	for _, column := range columns {
+		if t, ok := byName[column.Table]; ok {
+			t.Columns = append(t.Columns, column)
+		}
+	}
+
+	for _, ic := range indexColumns {
+		t, ok := byName[ic.Table]
+		if !ok {
+			continue
+		}
+
+		if n := len(t.Indexes); n == 0 || t.Indexes[n-1].Name != ic.Name {
+			t.Indexes = append(t.Indexes, Index{Name: ic.Name, Unique: ic.NonUnique == 0})
+		}
+		index := &t.Indexes[len(t.Indexes)-1]
+		index.Columns = append(index.Columns, ic.Column)
+	}
+
+	return tables, nil
+}
+
+func Tables(database string) ([]Table, error) {
+	return mysql.Tables(database)
+}
@@ -0,0 +1,547 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+type DriftKind string
+
+const (
+	DriftMissingTable  DriftKind = "missing table"
+	DriftMissingColumn DriftKind = "missing column"
+	DriftType          DriftKind = "type mismatch"
+	DriftNullable      DriftKind = "nullability"
+	DriftMissingIndex  DriftKind = "missing index"
+)
+
+/*
+ * Drift
+ *
+ * One difference between a model and its live table. Name is the column or
+ * the index, Model and Live what each side has. Alter is the statement
+ * moving the table to the model, empty when the model does not say enough,
+ * e.g. the column type of a field without a schema tag type.
+ */
+type Drift struct {
+	Kind  DriftKind
+	Table string
+	Name  string
+	Model string
+	Live  string
+	Alter string
+}
+
+func (d Drift) String() string {
+	var s string = d.Table
+	if d.Name != "" {
+		s += "." + d.Name
+	}
+	s += ": " + string(d.Kind) + ", model " + d.Model
+	if d.Live != "" {
+		s += ", table " + d.Live
+	}
+	return s
+}
+
+// Alters returns the statements of drifts, in order.
+func Alters(drifts []Drift) []string {
+	var alters []string
+	for _, d := range drifts {
+		if d.Alter != "" {
+			alters = append(alters, d.Alter)
+		}
+	}
+	return alters
+}
+
+type modelNull int
+
+const (
+	nullAny modelNull = iota // scans both, e.g. []byte
+	nullYes
+	nullNo
+)
+
+type modelColumn struct {
+	name   string
+	goType string // base type, e.g. NullString for *sql.NullString
+	typ    string // from the schema tag
+	null   modelNull
+}
+
+/*
+ * Model
+ *
+ * The table a Go struct maps to. Fields map to columns like in the scan
+ * helpers, by db tag or field name; embedded fields are skipped. The schema
+ * tag tells what the Go type does not, options separated by ";":
+ *
+ *	Email string `db:"email" schema:"type:varchar(128);unique:uk_email"`
+ *
+ *	type:T      the column type, compared with COLUMN_TYPE
+ *	null        the column is nullable, notnull that it is not
+ *	primary     part of the primary key
+ *	index:NAME  part of index NAME, unique:NAME of a unique one, in field order
+ *
+ * Without type the column is only checked to scan into the field, and a
+ * pointer or sql.Null* field means a nullable column.
+ */
+type Model struct {
+	Table   string
+	columns []modelColumn
+	indexes []Index
+}
+
+// ModelOf describes the struct model, or a pointer to one, as table. It panics when model is not a struct.
+func ModelOf(table string, model interface{}) Model {
+	t := reflect.TypeOf(model)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("db: ModelOf(%q) needs a struct, got %T", table, model))
+	}
+
+	m := Model{Table: table}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || field.Anonymous {
+			continue
+		}
+		m.AddField(field.Name, field.Type.String(), field.Tag)
+	}
+
+	return m
+}
+
+/*
+ * AddField adds a struct field by its Go type as written in source, e.g.
+ * "*sql.NullString", for callers reading models without reflection.
+ */
+func (m *Model) AddField(name string, goType string, tag reflect.StructTag) {
+	column := tag.Get("db")
+	if column == "-" {
+		return
+	}
+	if column == "" {
+		column = name
+	}
+
+	var pointer bool = strings.HasPrefix(goType, "*")
+	goType = strings.TrimLeft(goType, "*")
+	if goType == "[]uint8" {
+		goType = "[]byte"
+	}
+	if i := strings.LastIndex(goType, "."); i >= 0 {
+		goType = goType[i+1:]
+	}
+
+	c := modelColumn{name: column, goType: goType, null: goNull(goType)}
+	if pointer {
+		c.null = nullYes
+	}
+
+	for _, option := range strings.Split(tag.Get("schema"), ";") {
+		key, value := strings.TrimSpace(option), ""
+		if i := strings.Index(key, ":"); i >= 0 {
+			key, value = strings.TrimSpace(key[:i]), strings.TrimSpace(key[i+1:])
+		}
+
+		switch key {
+		case "type":
+			c.typ = value
+		case "null":
+			c.null = nullYes
+		case "notnull":
+			c.null = nullNo
+		case "primary":
+			m.addIndex("PRIMARY", true, column)
+		case "index":
+			if value == "" {
+				value = "idx_" + column
+			}
+			m.addIndex(value, false, column)
+		case "unique":
+			if value == "" {
+				value = "uk_" + column
+			}
+			m.addIndex(value, true, column)
+		}
+	}
+
+	m.columns = append(m.columns, c)
+}
+
+func (m *Model) addIndex(name string, unique bool, column string) {
+	for i := range m.indexes {
+		if m.indexes[i].Name == name {
+			m.indexes[i].Columns = append(m.indexes[i].Columns, column)
+			return
+		}
+	}
+	m.indexes = append(m.indexes, Index{Name: name, Unique: unique, Columns: []string{column}})
+}
+
+func goNull(goType string) modelNull {
+	switch {
+	case strings.HasPrefix(goType, "Null"):
+		return nullYes
+	case goIntegers[goType].width > 0, goType == "bool", goType == "float32", goType == "float64", goType == "string", goType == "Time":
+		return nullNo
+	}
+	return nullAny
+}
+
+type goInteger struct {
+	width    int
+	unsigned bool
+}
+
+var goIntegers = map[string]goInteger{
+	"int": {8, false}, "int64": {8, false}, "int32": {4, false}, "int16": {2, false}, "int8": {1, false},
+	"uint": {8, true}, "uint64": {8, true}, "uint32": {4, true}, "uint16": {2, true}, "uint8": {1, true}, "byte": {1, true},
+	"NullInt64": {8, false}, "NullInt32": {4, false}, "NullInt16": {2, false}, "NullByte": {1, true},
+}
+
+var integerWidths = map[string]int{"tinyint": 1, "smallint": 2, "mediumint": 3, "int": 4, "integer": 4, "bigint": 8, "year": 2}
+
+var textTypes = map[string]bool{
+	"char": true, "varchar": true, "tinytext": true, "text": true, "mediumtext": true, "longtext": true,
+	"binary": true, "varbinary": true, "tinyblob": true, "blob": true, "mediumblob": true, "longblob": true,
+}
+
+// scans reports whether column scans into a field of goType, known is false for types it cannot tell.
+func scans(goType string, column Column) (ok bool, known bool) {
+	dataType := strings.ToLower(column.DataType)
+	width, integer := integerWidths[dataType]
+
+	if i, found := goIntegers[goType]; found {
+		if !integer {
+			return false, true
+		}
+		if strings.Contains(column.ColumnType, "unsigned") {
+			// the top bit needs one more byte in a signed field
+			return width < i.width || (i.unsigned && width <= i.width), true
+		}
+		return !i.unsigned && width <= i.width, true
+	}
+
+	switch goType {
+	case "bool", "NullBool":
+		return integer, true
+	case "float32", "float64", "NullFloat64":
+		return integer || dataType == "float" || dataType == "double" || dataType == "real" || dataType == "decimal", true
+	case "string", "NullString", "[]byte", "RawBytes":
+		return true, true
+	case "Time", "NullTime":
+		return dataType == "date" || dataType == "datetime" || dataType == "timestamp", true
+	case "JSON", "RawMessage":
+		return dataType == "json" || textTypes[dataType], true
+	case "Encrypted":
+		return textTypes[dataType], true
+	}
+
+	return false, false
+}
+
+// defaultType is the column type added for a field without a schema tag type.
+func defaultType(goType string) string {
+	switch goType {
+	case "int", "int64", "NullInt64":
+		return "bigint"
+	case "uint", "uint64":
+		return "bigint unsigned"
+	case "int32", "NullInt32":
+		return "int"
+	case "uint32":
+		return "int unsigned"
+	case "int16", "NullInt16":
+		return "smallint"
+	case "uint16":
+		return "smallint unsigned"
+	case "int8":
+		return "tinyint"
+	case "uint8", "byte", "NullByte":
+		return "tinyint unsigned"
+	case "bool", "NullBool":
+		return "tinyint(1)"
+	case "float32":
+		return "float"
+	case "float64", "NullFloat64":
+		return "double"
+	case "string", "NullString":
+		return "varchar(255)"
+	case "[]byte":
+		return "blob"
+	case "Time", "NullTime":
+		return "datetime"
+	case "JSON", "RawMessage":
+		return "json"
+	case "Encrypted":
+		return "text"
+	}
+	return ""
+}
+
+var displayWidth = regexp.MustCompile(`\b(tinyint|smallint|mediumint|int|integer|bigint|year)\(\d+\)`)
+
+// sameType compares column types, ignoring case and the integer display width MySQL 8 no longer shows.
+func sameType(a string, b string) bool {
+	normalize := func(s string) string {
+		s = strings.Join(strings.Fields(strings.ToLower(s)), " ")
+		s = displayWidth.ReplaceAllString(s, "$1")
+		s = strings.Replace(s, "integer", "int", -1)
+		s = strings.Replace(s, "boolean", "tinyint", -1)
+		return strings.Replace(s, "bool", "tinyint", -1)
+	}
+	return normalize(a) == normalize(b)
+}
+
+/*
+ * Diff
+ *
+ * Compares models with the tables of database in information_schema and
+ * returns the drifts: missing tables, columns and indexes, type and
+ * nullability mismatches. Columns and indexes of the table the model does
+ * not have are not drifts. An index is found when a live one starts with
+ * its columns, whatever its name; a unique one needs exactly its columns.
+ */
+func (db *Mysql) Diff(database string, models ...Model) ([]Drift, error) {
+	tables, err := db.Tables(database)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*Table, len(tables))
+	for i := range tables {
+		byName[strings.ToLower(tables[i].Name)] = &tables[i]
+	}
+
+	var drifts []Drift
+	for _, model := range models {
+		table, ok := byName[strings.ToLower(model.Table)]
+		if !ok {
+			drifts = append(drifts, Drift{Kind: DriftMissingTable, Table: model.Table, Model: model.Table, Alter: createTable(model)})
+			continue
+		}
+		drifts = append(drifts, diffTable(model, table)...)
+	}
+
+	return drifts, nil
+}
+
+func Diff(database string, models ...Model) ([]Drift, error) {
+	return mysql.Diff(database, models...)
+}
+
+func diffTable(model Model, table *Table) []Drift {
+	var drifts []Drift
+
+	columns := make(map[string]*Column, len(table.Columns))
+	for i := range table.Columns {
+		columns[strings.ToLower(table.Columns[i].Name)] = &table.Columns[i]
+	}
+
+	for _, c := range model.columns {
+		live, ok := columns[strings.ToLower(c.name)]
+		if !ok {
+			d := Drift{Kind: DriftMissingColumn, Table: model.Table, Name: c.name, Model: c.describe()}
+			if typ := c.columnType(); typ != "" {
+				d.Alter = fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN %s", model.Table, c.definition(typ))
+			}
+			drifts = append(drifts, d)
+			continue
+		}
+
+		// a type MODIFY also sets the nullability
+		var modified bool = c.typ != "" && !sameType(c.typ, live.ColumnType)
+		if modified {
+			drifts = append(drifts, Drift{Kind: DriftType, Table: model.Table, Name: c.name, Model: c.typ, Live: live.ColumnType,
+				Alter: fmt.Sprintf("ALTER TABLE `%s` MODIFY COLUMN %s", model.Table, modifyColumn(c, live, c.typ))})
+		} else if ok, known := scans(c.goType, *live); c.typ == "" && known && !ok {
+			drifts = append(drifts, Drift{Kind: DriftType, Table: model.Table, Name: c.name, Model: c.goType, Live: live.ColumnType})
+		}
+
+		if c.null != nullAny && (c.null == nullYes) != live.Nullable() {
+			typ := live.ColumnType
+			if c.typ != "" {
+				typ = c.typ
+			}
+			d := Drift{Kind: DriftNullable, Table: model.Table, Name: c.name, Model: nullName(c.null == nullYes), Live: nullName(live.Nullable())}
+			if !modified {
+				d.Alter = fmt.Sprintf("ALTER TABLE `%s` MODIFY COLUMN %s", model.Table, modifyColumn(c, live, typ))
+			}
+			drifts = append(drifts, d)
+		}
+	}
+
+	for _, index := range model.indexes {
+		if hasIndex(table.Indexes, index) {
+			continue
+		}
+		drifts = append(drifts, Drift{Kind: DriftMissingIndex, Table: model.Table, Name: index.Name, Model: indexName(index),
+			Alter: fmt.Sprintf("ALTER TABLE `%s` ADD %s", model.Table, indexDefinition(index))})
+	}
+
+	return drifts
+}
+
+func hasIndex(live []Index, index Index) bool {
+	for _, l := range live {
+		if len(l.Columns) < len(index.Columns) || (index.Unique && (!l.Unique || len(l.Columns) != len(index.Columns))) {
+			continue
+		}
+
+		var covered bool = true
+		for i, column := range index.Columns {
+			if !strings.EqualFold(l.Columns[i], column) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+func (c modelColumn) describe() string {
+	if c.typ != "" {
+		return c.typ
+	}
+	return c.goType
+}
+
+func (c modelColumn) columnType() string {
+	if c.typ != "" {
+		return c.typ
+	}
+	return defaultType(c.goType)
+}
+
+func (c modelColumn) definition(typ string) string {
+	var s string = "`" + c.name + "` " + typ
+	switch c.null {
+	case nullYes:
+		s += " NULL"
+	case nullNo:
+		s += " NOT NULL"
+	}
+	return s
+}
+
+// modifyColumn redefines live as typ with the model nullability, keeping its default, extra and comment MODIFY would drop.
+func modifyColumn(c modelColumn, live *Column, typ string) string {
+	if c.null == nullAny {
+		if live.Nullable() {
+			c.null = nullYes
+		} else {
+			c.null = nullNo
+		}
+	}
+
+	var s string = c.definition(typ)
+	if live.Default.Valid {
+		var value string = live.Default.String
+		if strings.Contains(strings.ToUpper(live.Extra), "DEFAULT_GENERATED") {
+			if !strings.HasPrefix(strings.ToUpper(value), "CURRENT_TIMESTAMP") {
+				value = "(" + value + ")"
+			}
+		} else {
+			value = quoteString(value)
+		}
+		s += " DEFAULT " + value
+	}
+
+	extra := strings.TrimSpace(strings.Replace(strings.ToUpper(live.Extra), "DEFAULT_GENERATED", "", 1))
+	if extra == "AUTO_INCREMENT" || strings.HasPrefix(extra, "ON UPDATE") {
+		s += " " + extra
+	}
+	if live.Comment != "" {
+		s += " COMMENT " + quoteString(live.Comment)
+	}
+	return s
+}
+
+func quoteString(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), "'", "''", -1) + "'"
+}
+
+func nullName(nullable bool) string {
+	if nullable {
+		return "NULL"
+	}
+	return "NOT NULL"
+}
+
+func indexName(index Index) string {
+	var kind string = "INDEX"
+	if index.Name == "PRIMARY" {
+		kind = "PRIMARY KEY"
+	} else if index.Unique {
+		kind = "UNIQUE INDEX"
+	}
+	return kind + " (" + strings.Join(index.Columns, ",") + ")"
+}
+
+func indexDefinition(index Index) string {
+	var columns string = "(`" + strings.Join(index.Columns, "`,`") + "`)"
+	if index.Name == "PRIMARY" {
+		return "PRIMARY KEY " + columns
+	}
+	if index.Unique {
+		return "UNIQUE INDEX `" + index.Name + "` " + columns
+	}
+	return "INDEX `" + index.Name + "` " + columns
+}
+
+// createTable is empty when a column type is unknown.
+func createTable(model Model) string {
+	var definitions []string
+	for _, c := range model.columns {
+		typ := c.columnType()
+		if typ == "" {
+			return ""
+		}
+		definitions = append(definitions, c.definition(typ))
+	}
+	for _, index := range model.indexes {
+		definitions = append(definitions, indexDefinition(index))
+	}
+
+	return fmt.Sprintf("CREATE TABLE `%s` (%s) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4", model.Table, strings.Join(definitions, ","))
+}
+
+// SchemaT is the part of testing.TB AssertSchema uses.
+type SchemaT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+/*
+ * AssertSchema fails t with one error per drift of models from the tables of
+ * database, e.g. in an integration test run against a migrated database:
+ *
+ *	db.AssertSchema(t, mysql, "shop", db.ModelOf("user", User{}), db.ModelOf("order", Order{}))
+ */
+func AssertSchema(t SchemaT, db *Mysql, database string, models ...Model) {
+	t.Helper()
+
+	drifts, err := db.Diff(database, models...)
+	if err != nil {
+		t.Errorf("schema diff: %v", err)
+		return
+	}
+
+	for _, d := range drifts {
+		if d.Alter != "" {
+			t.Errorf("%s\n\t%s", d, d.Alter)
+		} else {
+			t.Errorf("%s", d)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ShardTable is replaced with the physical table name in sharded queries.
+const ShardTable = "{table}"
+
+var ErrShardKey = errors.New("unsupported shard key type")
+
+/*
+ * ShardConfig
+ *
+ * Table is split into Count physical tables named Table + "_NN" (order_00 ..
+ * order_63), spread over Hosts in contiguous blocks: with 64 tables and 4
+ * hosts, order_00..order_15 live on Hosts[0] and so on.
+ *
+ * Shards lays the tables out explicitly instead, from table suffix to host:
+ * {"00": a, "01": b, "02": a} is order_00 and order_02 on a, order_01 on b.
+ * A key goes to the shard at hash % len(Shards) in suffix order, so pad
+ * numeric suffixes to the same width.
+ */
+type ShardConfig struct {
+	Table  string                 `yaml:"Table"`
+	Count  int                    `yaml:"Count"`
+	Hosts  []MysqlConfig          `yaml:"Hosts"`
+	Shards map[string]MysqlConfig `yaml:"Shards"`
+}
+
+type shard struct {
+	table string
+	db    *Mysql
+}
+
+/*
+ * ShardRouter
+ *
+ * Routes the rows of a logical table to its physical tables. Audit,
+ * EncryptColumn and TenantTable register physical tables on an instance,
+ * and SetTracer, SetLimits, SetCache, ... configure an instance: make them
+ * on the instances of Tables, or build the instances and pass them to
+ * NewShardRouterWith.
+ */
+type ShardRouter struct {
+	table  string
+	shards []shard
+	hash   func(key interface{}) (uint64, error)
+	owned  bool // Close closes the instances
+}
+
+// NewShardRouter opens one instance per host of config, closed by Close.
+func NewShardRouter(config ShardConfig) *ShardRouter {
+	layout := config.Shards
+	if len(layout) == 0 {
+		if config.Count <= 0 || len(config.Hosts) == 0 {
+			panic("分表配置错误: " + config.Table)
+		}
+
+		var width int = len(fmt.Sprint(config.Count - 1))
+		if width < 2 {
+			width = 2
+		}
+
+		layout = make(map[string]MysqlConfig, config.Count)
+		for i := 0; i < config.Count; i++ {
+			layout[fmt.Sprintf("%0*d", width, i)] = config.Hosts[i*len(config.Hosts)/config.Count]
+		}
+	}
+
+	// one pool per host, shared by its tables
+	hosts := make(map[MysqlConfig]*Mysql)
+	instances := make(map[string]*Mysql, len(layout))
+	for suffix, hostConfig := range layout {
+		if hosts[hostConfig] == nil {
+			hosts[hostConfig] = NewMysql(hostConfig)
+			hosts[hostConfig].Open()
+		}
+		instances[suffix] = hosts[hostConfig]
+	}
+
+	r := NewShardRouterWith(config.Table, instances)
+	r.owned = true
+
+	return r
+}
+
+/*
+ * NewShardRouterWith routes table over instances the caller built and
+ * configured, from table suffix to instance as in ShardConfig.Shards, e.g.
+ * Fake instances in tests. Close leaves them open.
+ */
+func NewShardRouterWith(table string, shards map[string]*Mysql) *ShardRouter {
+	if len(shards) == 0 {
+		panic("分表配置错误: " + table)
+	}
+
+	suffixes := make([]string, 0, len(shards))
+	for suffix := range shards {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Strings(suffixes)
+
+	r := &ShardRouter{table: table, hash: shardHash}
+	for _, suffix := range suffixes {
+		r.shards = append(r.shards, shard{table: table + "_" + suffix, db: shards[suffix]})
+	}
+
+	return r
+}
+
+// Tables returns the instance of each physical table, e.g. to register them.
+func (r *ShardRouter) Tables() map[string]*Mysql {
+	tables := make(map[string]*Mysql, len(r.shards))
+	for _, s := range r.shards {
+		tables[s.table] = s.db
+	}
+	return tables
+}
+
+// SetHash replaces the default hash (integers by value, strings by crc32) used to pick a shard.
+func (r *ShardRouter) SetHash(hash func(key interface{}) (uint64, error)) {
+	r.hash = hash
+}
+
+// shardHash keeps integers whole, so the shard is key % count as in tables split by hand.
+func shardHash(key interface{}) (uint64, error) {
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if n < 0 {
+			n = -n
+		}
+		return uint64(n), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), nil
+	case reflect.String:
+		return uint64(crc32.ChecksumIEEE([]byte(v.String()))), nil
+	}
+
+	return 0, ErrShardKey
+}
+
+// Shard returns the physical table and host for key.
+func (r *ShardRouter) Shard(key interface{}) (string, *Mysql, error) {
+	h, err := r.hash(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s := r.shards[h%uint64(len(r.shards))]
+	return s.table, s.db, nil
+}
+
+func (r *ShardRouter) Add(key interface{}, insertData map[string]interface{}) (int64, error) {
+	table, db, err := r.Shard(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return db.Add(table, insertData)
+}
+
+func (r *ShardRouter) Update(key interface{}, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
+	table, db, err := r.Shard(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return db.Update(table, updateData, condition)
+}
+
+func (r *ShardRouter) Delete(key interface{}, condition map[string]interface{}) (int64, error) {
+	table, db, err := r.Shard(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return db.Delete(table, condition)
+}
+
+// Query runs query on the shard of key, with ShardTable in query replaced by the physical table.
+func (r *ShardRouter) Query(key interface{}, dest interface{}, query string, args ...interface{}) error {
+	table, db, err := r.Shard(key)
+	if err != nil {
+		return err
+	}
+
+	return db.scanQuery(table, dest, strings.Replace(query, ShardTable, table, -1), args...)
+}
+
+/*
+ * QueryAll
+ *
+ * Scatter-gather read: query runs on every shard concurrently and the results
+ * are appended to dest in shard order. They are not merge-sorted: ORDER BY
+ * and LIMIT apply per shard, sort and trim dest afterwards.
+ */
+func (r *ShardRouter) QueryAll(dest interface{}, query string, args ...interface{}) error {
+	sliceVal := reflect.ValueOf(dest)
+	if sliceVal.Kind() != reflect.Ptr || sliceVal.Elem().Kind() != reflect.Slice {
+		return ErrScanDest
+	}
+	sliceVal = sliceVal.Elem()
+
+	results := make([]reflect.Value, len(r.shards))
+	errs := make([]error, len(r.shards))
+
+	var wg sync.WaitGroup
+	for i, s := range r.shards {
+		wg.Add(1)
+		go func(i int, s shard) {
+			defer wg.Done()
+
+			part := reflect.New(sliceVal.Type())
+			errs[i] = s.db.scanQuery(s.table, part.Interface(), strings.Replace(query, ShardTable, s.table, -1), args...)
+			results[i] = part.Elem()
+		}(i, s)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	merged := sliceVal.Slice(0, 0)
+	for _, part := range results {
+		merged = reflect.AppendSlice(merged, part)
+	}
+	sliceVal.Set(merged)
+
+	return nil
+}
+
+func (r *ShardRouter) Close() {
+	if !r.owned {
+		return
+	}
+
+	closed := make(map[*Mysql]bool)
+	for _, s := range r.shards {
+		if !closed[s.db] {
+			s.db.Close()
+			closed[s.db] = true
+		}
+	}
+}
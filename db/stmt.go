@@ -0,0 +1,153 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+)
+
+const defaultStmtCacheSize = 64
+
+type StmtStats struct {
+	Size      int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+type stmtEntry struct {
+	query   string
+	stmt    *sql.Stmt
+	refs    int
+	evicted bool
+}
+
+/*
+ * stmtCache is a LRU of prepared statements keyed by sql text.
+ * Evicted statements are closed once the last borrower releases them.
+ */
+type stmtCache struct {
+	mu        sync.Mutex
+	size      int
+	ll        *list.List
+	items     map[string]*list.Element
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+func newStmtCache(size int) *stmtCache {
+	return &stmtCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get borrows the statement for query, preparing it on a miss. Call release when done.
+func (c *stmtCache) get(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, func(), error) {
+	if stmt, release, ok := c.lookup(query); ok {
+		return stmt, release, nil
+	}
+
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// another goroutine may have prepared the same query meanwhile
+	if el, ok := c.items[query]; ok {
+		stmt.Close()
+		c.ll.MoveToFront(el)
+		entry := el.Value.(*stmtEntry)
+		entry.refs++
+		return entry.stmt, c.releaseFunc(entry), nil
+	}
+
+	entry := &stmtEntry{query: query, stmt: stmt, refs: 1}
+	c.items[query] = c.ll.PushFront(entry)
+
+	for c.ll.Len() > 0 && c.ll.Len() > c.size {
+		c.evict(c.ll.Back())
+	}
+
+	return stmt, c.releaseFunc(entry), nil
+}
+
+/*
+ * lookup borrows the statement for query only if it is cached. A tx uses it:
+ * preparing on the pool needs a second connection, which never comes when
+ * every connection is held by a tx.
+ */
+func (c *stmtCache) lookup(query string) (*sql.Stmt, func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[query]
+	if !ok {
+		c.misses++
+		return nil, nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	entry := el.Value.(*stmtEntry)
+	entry.refs++
+	c.hits++
+
+	return entry.stmt, c.releaseFunc(entry), true
+}
+
+func (c *stmtCache) releaseFunc(entry *stmtEntry) func() {
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		entry.refs--
+		if entry.evicted && entry.refs == 0 {
+			entry.stmt.Close()
+		}
+	}
+}
+
+// evict must be called with c.mu held.
+func (c *stmtCache) evict(el *list.Element) {
+	entry := el.Value.(*stmtEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.query)
+	c.evictions++
+
+	entry.evicted = true
+	if entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+func (c *stmtCache) resize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = size
+	for c.ll.Len() > 0 && c.ll.Len() > c.size {
+		c.evict(c.ll.Back())
+	}
+}
+
+func (c *stmtCache) stats() StmtStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return StmtStats{
+		Size:      c.ll.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+func (c *stmtCache) close() {
+	c.resize(0)
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+const defaultTenantColumn = "tenant_id"
+
+var (
+	ErrNoTenant       = errors.New("tenant scoped table used without tenant in context")
+	ErrTenantMismatch = errors.New("tenant column does not match the tenant in context")
+)
+
+type tenantKey struct{}
+
+// WithTenant tags ctx with the tenant the request acts for.
+func WithTenant(ctx context.Context, tenant interface{}) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext reports a zero tenant, such as "" or 0, as missing.
+func TenantFromContext(ctx context.Context) (interface{}, bool) {
+	tenant := ctx.Value(tenantKey{})
+	if tenant == nil || reflect.ValueOf(tenant).IsZero() {
+		return nil, false
+	}
+	return tenant, true
+}
+
+/*
+ * TenantTable
+ *
+ * Scopes table to the tenant of the context (see WithTenant) in column,
+ * "tenant_id" when empty: Add fills the column, Update, Delete and the
+ * table helpers (Count, Exists, Sum, Max, Min, Paginate, Chunk and the
+ * row lock selects) add `AND column=?`. Without a tenant in the context,
+ * or with a zero one such as "" or 0, they fail with ErrNoTenant, and a different tenant in the data or
+ * condition fails with ErrTenantMismatch.
+ *
+ * TxInstance methods without a context use the one of BeginTxContext.
+ * Raw Query, Exec, CachedQuery and BulkLoad are not scoped.
+ */
+func (db *Mysql) TenantTable(table string, column string) {
+	if column == "" {
+		column = defaultTenantColumn
+	}
+	if db.tenants == nil {
+		db.tenants = make(map[string]string)
+	}
+	db.tenants[table] = column
+}
+
+func TenantTable(table string, column string) {
+	mysql.TenantTable(table, column)
+}
+
+// scopeTenant returns a copy of data with column set to the tenant of ctx,
+// refusing a different tenant already in data.
+func (db *Mysql) scopeTenant(ctx context.Context, table string, data map[string]interface{}) (map[string]interface{}, error) {
+	if db == nil || db.tenants == nil {
+		return data, nil
+	}
+
+	column, ok := db.tenants[table]
+	if !ok {
+		return data, nil
+	}
+
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+
+	scoped := make(map[string]interface{}, len(data)+1)
+	for k, v := range data {
+		scoped[k] = v
+	}
+
+	if v, ok := scoped[column]; ok && fmt.Sprint(v) != fmt.Sprint(tenant) {
+		return nil, ErrTenantMismatch
+	}
+	scoped[column] = tenant
+
+	return scoped, nil
+}
+
+// prepareInsert applies tenant scoping and column encryption to insertData.
+func (db *Mysql) prepareInsert(ctx context.Context, table string, insertData map[string]interface{}) (map[string]interface{}, error) {
+	insertData, err := db.scopeTenant(ctx, table, insertData)
+	if err != nil {
+		return nil, err
+	}
+
+	insertData, _, err = db.sealWrite(table, insertData, nil)
+	return insertData, err
+}
+
+func (db *Mysql) prepareUpdate(ctx context.Context, table string, updateData map[string]interface{}, condition map[string]interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	condition, err := db.scopeTenant(ctx, table, condition)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the tenant column may be set, but only to the same tenant
+	if column, ok := db.tenants[table]; ok {
+		if v, ok := updateData[column]; ok && fmt.Sprint(v) != fmt.Sprint(condition[column]) {
+			return nil, nil, ErrTenantMismatch
+		}
+	}
+
+	return db.sealWrite(table, updateData, condition)
+}
+
+func (db *Mysql) prepareCondition(ctx context.Context, table string, condition map[string]interface{}) (map[string]interface{}, error) {
+	condition, err := db.scopeTenant(ctx, table, condition)
+	if err != nil {
+		return nil, err
+	}
+
+	_, condition, err = db.sealWrite(table, nil, condition)
+	return condition, err
+}
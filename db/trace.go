@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// span attributes, named after the OpenTelemetry database conventions
+const (
+	AttrSystem       = "db.system"
+	AttrStatement    = "db.statement"
+	AttrTable        = "db.sql.table"
+	AttrRowsAffected = "db.rows_affected"
+)
+
+/*
+ * Tracer opens a span per db operation of the Context methods: Add, Update,
+ * Delete, Query, Exec, BeginTx, Commit and Rollback. It is small enough to
+ * wrap an OpenTelemetry trace.Tracer, Recorder implements it for tests.
+ */
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End(err error)
+}
+
+type spanKey struct{}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+
+func (noopSpan) End(err error) {}
+
+func (db *Mysql) SetTracer(tracer Tracer) {
+	db.tracer = tracer
+}
+
+func SetTracer(tracer Tracer) {
+	mysql.SetTracer(tracer)
+}
+
+func (db *Mysql) startSpan(ctx context.Context, name string, table string) (context.Context, Span) {
+	if db == nil || db.tracer == nil {
+		return ctx, noopSpan{}
+	}
+
+	ctx, span := db.tracer.Start(ctx, name)
+	span.SetAttribute(AttrSystem, "mysql")
+	if table != "" {
+		span.SetAttribute(AttrTable, table)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// traceStatement tags the current span of ctx with the sql it runs.
+func traceStatement(ctx context.Context, query string) {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		span.SetAttribute(AttrStatement, query)
+	}
+}
+
+func endSpan(span Span, rowsAffected int64, err error) {
+	if err == nil {
+		span.SetAttribute(AttrRowsAffected, rowsAffected)
+	}
+	span.End(err)
+}
+
+type RecordedSpan struct {
+	Name       string
+	Parent     string
+	Attributes map[string]interface{}
+	Err        error
+	Start      time.Time
+	End        time.Time
+}
+
+// Recorder is an in-memory Tracer for tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+type recorderSpan struct {
+	recorder *Recorder
+	span     RecordedSpan
+	mu       sync.Mutex
+}
+
+type recorderKey struct{}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recorderSpan{
+		recorder: r,
+		span: RecordedSpan{
+			Name:       name,
+			Attributes: make(map[string]interface{}),
+			Start:      time.Now(),
+		},
+	}
+	if parent, ok := ctx.Value(recorderKey{}).(*recorderSpan); ok {
+		span.span.Parent = parent.span.Name
+	}
+
+	return context.WithValue(ctx, recorderKey{}, span), span
+}
+
+// Spans returns the ended spans in the order they ended.
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]RecordedSpan(nil), r.spans...)
+}
+
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = nil
+}
+
+func (s *recorderSpan) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.span.Attributes[key] = value
+}
+
+func (s *recorderSpan) End(err error) {
+	s.mu.Lock()
+	s.span.Err = err
+	s.span.End = time.Now()
+	span := s.span
+	s.mu.Unlock()
+
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+
+	s.recorder.spans = append(s.recorder.spans, span)
+}
@@ -1,28 +1,180 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"github.com/MangoMilk/go-lib/dwarflog"
-	"strings"
 )
 
 type TxInstance struct {
-	Tx *sql.Tx
+	Tx  *sql.Tx
+	db  *Mysql
+	ctx context.Context // of BeginTxContext, used by the methods without a context
+
+	// the pool of Tx, pinned until Commit or Rollback
+	pool    *pool
+	release func()
+
+	// tables written in the tx, their cached reads are dropped on commit
+	dirty map[string]struct{}
+}
+
+func (db *Mysql) BeginTx() (*TxInstance, error) {
+	return db.BeginTxContext(context.Background())
+}
+
+func (db *Mysql) BeginTxContext(ctx context.Context) (*TxInstance, error) {
+
+	_, span := db.startSpan(ctx, "db.BeginTx", "")
+
+	st, err := db.guard(ctx, "", "")
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+
+	p, release := db.acquire()
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	st.finish(err)
+	if err != nil {
+		release()
+		err = Classify(err)
+		span.End(err)
+		return nil, err
+	}
+	span.End(nil)
+
+	return &TxInstance{Tx: tx, db: db, ctx: ctx, pool: p, release: release}, nil
 }
 
 func BeginTx() (*TxInstance, error) {
+	return mysql.BeginTx()
+}
+
+func BeginTxContext(ctx context.Context) (*TxInstance, error) {
+	return mysql.BeginTxContext(ctx)
+}
 
-	tx, err := mysql.Instance.Begin()
+// inTx runs fn in a new tx, committing when fn returns nil and rolling back otherwise.
+func (db *Mysql) inTx(ctx context.Context, fn func(tx *TxInstance) error) error {
+	tx, err := db.BeginTxContext(ctx)
 	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// exec re-binds the cached prepared statement to the tx, so it is prepared once per connection.
+// A statement not cached yet runs directly on the tx, see stmtCache.lookup.
+func (i *TxInstance) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	traceStatement(ctx, query)
+
+	if i.Tx == nil {
+		return nil, ErrNoTx
+	}
+
+	if i.pool == nil || i.pool.stmts == nil {
+		return i.Tx.ExecContext(ctx, query, args...)
+	}
+
+	stmt, release, ok := i.pool.stmts.lookup(query)
+	if !ok {
+		return i.Tx.ExecContext(ctx, query, args...)
+	}
+	defer release()
+
+	txStmt := i.Tx.StmtContext(ctx, stmt)
+	defer txStmt.Close()
+
+	return txStmt.ExecContext(ctx, args...)
+}
+
+func (i *TxInstance) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return i.QueryContext(i.txContext(), query, args...)
+}
+
+func (i *TxInstance) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return i.ExecContext(i.txContext(), query, args...)
+}
+
+func (i *TxInstance) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if i.Tx == nil {
+		return nil, ErrNoTx
+	}
+
+	ctx, span := i.db.startSpan(ctx, "db.Query", "")
+	span.SetAttribute(AttrStatement, query)
+
+	i.db.explain(ctx, query, args)
+
+	st, err := i.db.guard(ctx, "", query)
+	if err != nil {
+		span.End(err)
 		return nil, err
 	}
 
-	return &TxInstance{tx}, nil
+	rows, err := i.Tx.QueryContext(st.ctx, st.query, args...)
+	err = Classify(err)
+	st.release(err)
+	span.End(err)
+
+	return rows, err
+}
+
+func (i *TxInstance) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if i.Tx == nil {
+		return nil, ErrNoTx
+	}
+
+	ctx, span := i.db.startSpan(ctx, "db.Exec", "")
+	span.SetAttribute(AttrStatement, query)
+
+	st, err := i.db.guard(ctx, "", query)
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+
+	res, err := i.Tx.ExecContext(st.ctx, st.query, args...)
+	err = Classify(err)
+	st.finish(err)
+
+	var affectedRows int64
+	if err == nil {
+		affectedRows, _ = res.RowsAffected()
+	}
+	endSpan(span, affectedRows, err)
+
+	return res, err
+}
+
+// txContext returns the context of BeginTxContext, carrying tenant, actor and span.
+func (i *TxInstance) txContext() context.Context {
+	if i.ctx == nil {
+		return context.Background()
+	}
+	return i.ctx
 }
 
 func (i *TxInstance) Commit() error {
 	if i.Tx != nil {
+		_, span := i.db.startSpan(i.txContext(), "db.Commit", "")
 		err := i.Tx.Commit()
+		span.End(err)
+		if err == nil {
+			for table := range i.dirty {
+				i.db.invalidate(table)
+			}
+		}
+		i.dirty = nil
+		i.done()
 		return err
 	} else {
 		return ErrNoTx
@@ -31,118 +183,172 @@ func (i *TxInstance) Commit() error {
 
 func (i *TxInstance) Rollback() error {
 	if i.Tx != nil {
+		_, span := i.db.startSpan(i.txContext(), "db.Rollback", "")
 		err := i.Tx.Rollback()
+		span.End(err)
+		i.dirty = nil
+		i.done()
 		return err
 	} else {
 		return ErrNoTx
 	}
 }
 
+// done unpins the pool, the first Commit or Rollback ends the tx either way.
+func (i *TxInstance) done() {
+	if i.release != nil {
+		i.release()
+		i.release = nil
+	}
+}
+
+func (i *TxInstance) markDirty(table string) {
+	if i.dirty == nil {
+		i.dirty = make(map[string]struct{})
+	}
+	i.dirty[table] = struct{}{}
+}
+
 func (i *TxInstance) Add(table string, insertData map[string]interface{}) (int64, error) {
+	return i.AddContext(i.txContext(), table, insertData)
+}
 
-	var fieldStr string = "("
-	var placeHolderStr string = "("
-	var args []interface{}
+func (i *TxInstance) AddContext(ctx context.Context, table string, insertData map[string]interface{}) (int64, error) {
+	ctx, span := i.db.startSpan(ctx, "db.Add", table)
+	n, err := i.add(ctx, table, insertData)
+	endSpan(span, n, err)
 
-	for k, v := range insertData {
-		fieldStr += "`" + k + "`,"
-		placeHolderStr += "?,"
-		args = append(args, v)
-	}
+	return n, err
+}
 
-	fieldStr = strings.Trim(fieldStr, ",") + ")"
-	placeHolderStr = strings.Trim(placeHolderStr, ",") + ")"
+func (i *TxInstance) add(ctx context.Context, table string, insertData map[string]interface{}) (int64, error) {
 
-	var sqlStr string = "INSERT INTO " + table + " " + fieldStr + " VALUES " + placeHolderStr
+	insertData, prepareErr := i.db.prepareInsert(ctx, table, insertData)
+	if prepareErr != nil {
+		return 0, prepareErr
+	}
 
-	res, insertErr := i.Tx.Exec(sqlStr, args...)
+	sqlStr, args := buildInsert(table, insertData)
 
-	// panic("sql:" + sqlStr)
-	// panic(args)
+	st, guardErr := i.db.guard(ctx, table, sqlStr)
+	if guardErr != nil {
+		return 0, guardErr
+	}
+	res, insertErr := i.exec(st.ctx, st.query, args...)
+	st.finish(insertErr)
 
 	if insertErr != nil {
 		dwarflog.Error(insertErr, sqlStr, args)
-		return 0, insertErr
+		return 0, Classify(insertErr)
 	}
 
+	i.markDirty(table)
+
 	//插入数据的主键id
 	lastInsertId, _ := res.LastInsertId()
 
+	if auditErr := i.auditInsert(ctx, table, lastInsertId, insertData); auditErr != nil {
+		return 0, auditErr
+	}
+
 	return lastInsertId, nil
 }
 
 func (i *TxInstance) Update(table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
+	return i.UpdateContext(i.txContext(), table, updateData, condition)
+}
 
-	var fieldStr string = ""
-	var conditionStr string = ""
-	var args []interface{}
-
-	// update data
-	for k, v := range updateData {
-		fieldStr += "`" + k + "`=?,"
-		args = append(args, v)
-	}
+func (i *TxInstance) UpdateContext(ctx context.Context, table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
+	ctx, span := i.db.startSpan(ctx, "db.Update", table)
+	n, err := i.update(ctx, table, updateData, condition)
+	endSpan(span, n, err)
 
-	fieldStr = strings.Trim(fieldStr, ",")
+	return n, err
+}
 
-	// condition
-	var conditionCount int = len(condition)
-	var c int = 1
-	for key, val := range condition {
-		conditionStr += "`" + key + "`=?"
-		args = append(args, val)
+func (i *TxInstance) update(ctx context.Context, table string, updateData map[string]interface{}, condition map[string]interface{}) (int64, error) {
 
-		if c != conditionCount {
-			conditionStr += " AND "
-		}
+	updateData, condition, prepareErr := i.db.prepareUpdate(ctx, table, updateData, condition)
+	if prepareErr != nil {
+		return 0, prepareErr
+	}
 
-		c++
+	before, auditErr := i.auditSnapshot(ctx, table, condition)
+	if auditErr != nil {
+		return 0, auditErr
 	}
 
-	var sqlStr string = "UPDATE " + table + " SET " + fieldStr + " WHERE " + conditionStr
+	sqlStr, args := buildUpdate(table, updateData, condition)
 
-	res, updateErr := i.Tx.Exec(sqlStr, args...)
+	st, guardErr := i.db.guard(ctx, table, sqlStr)
+	if guardErr != nil {
+		return 0, guardErr
+	}
+	res, updateErr := i.exec(st.ctx, st.query, args...)
+	st.finish(updateErr)
 
 	if updateErr != nil {
 		dwarflog.Error(updateErr, sqlStr, args)
-		return 0, updateErr
+		return 0, Classify(updateErr)
 	}
 
+	i.markDirty(table)
+
 	affectedRows, _ := res.RowsAffected()
 
+	if auditErr := i.auditUpdate(ctx, table, before, updateData); auditErr != nil {
+		return 0, auditErr
+	}
+
 	return affectedRows, nil
 
 }
 
 func (i *TxInstance) Delete(table string, condition map[string]interface{}) (int64, error) {
+	return i.DeleteContext(i.txContext(), table, condition)
+}
 
-	var conditionStr string = ""
-	var args []interface{}
+func (i *TxInstance) DeleteContext(ctx context.Context, table string, condition map[string]interface{}) (int64, error) {
+	ctx, span := i.db.startSpan(ctx, "db.Delete", table)
+	n, err := i.delete(ctx, table, condition)
+	endSpan(span, n, err)
 
-	// condition
-	var conditionCount int = len(condition)
-	var c int = 1
-	for key, val := range condition {
-		conditionStr += "`" + key + "`=?"
-		args = append(args, val)
+	return n, err
+}
 
-		if c != conditionCount {
-			conditionStr += " AND "
-		}
+func (i *TxInstance) delete(ctx context.Context, table string, condition map[string]interface{}) (int64, error) {
 
-		c++
+	condition, prepareErr := i.db.prepareCondition(ctx, table, condition)
+	if prepareErr != nil {
+		return 0, prepareErr
 	}
 
-	var sqlStr string = "DELETE FROM " + table + " WHERE " + conditionStr
+	before, auditErr := i.auditSnapshot(ctx, table, condition)
+	if auditErr != nil {
+		return 0, auditErr
+	}
+
+	sqlStr, args := buildDelete(table, condition)
 
-	res, updateErr := i.Tx.Exec(sqlStr, args...)
+	st, guardErr := i.db.guard(ctx, table, sqlStr)
+	if guardErr != nil {
+		return 0, guardErr
+	}
+	res, updateErr := i.exec(st.ctx, st.query, args...)
+	st.finish(updateErr)
 
 	if updateErr != nil {
 		dwarflog.Error(updateErr, sqlStr, args)
-		return 0, updateErr
+		return 0, Classify(updateErr)
 	}
 
+	i.markDirty(table)
+
 	affectedRows, _ := res.RowsAffected()
 
+	if auditErr := i.auditDelete(ctx, table, before); auditErr != nil {
+		return 0, auditErr
+	}
+
 	return affectedRows, nil
 }
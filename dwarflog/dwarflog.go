@@ -31,10 +31,11 @@ const (
 	PanicLevel = LogLevel("panic")
 	FatalLevel = LogLevel("fatal")
 	ErrorLevel = LogLevel("error")
+	WarnLevel  = LogLevel("warn")
 	InfoLevel  = LogLevel("info")
 )
 
-var logLevels = []LogLevel{ErrorLevel, InfoLevel}
+var logLevels = []LogLevel{ErrorLevel, WarnLevel, InfoLevel}
 
 type lg struct {
 	lgr        *log.Logger
@@ -80,3 +80,10 @@ func TestErrorLog(t *testing.T) {
 	}
 	Error("【Response】", r)
 }
+
+func TestWarnLog(t *testing.T) {
+	Warn("123")
+
+	m := map[string]interface{}{"a": 1, "b": "b"}
+	Warn("【Explain】", m)
+}
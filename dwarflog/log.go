@@ -66,6 +66,23 @@ func Infoln(v ...interface{}) {
 	l.lgr.Println(log)
 }
 
+func Warn(v ...interface{}) {
+	l.lgr.SetOutput(l.files[l.getLevelDate(WarnLevel)])
+	log := l.ProcessLogFormat(WarnLevel, v...)
+	l.lgr.Print(log)
+}
+
+func Warnf(format string, v ...interface{}) {
+	l.lgr.SetOutput(l.files[l.getLevelDate(WarnLevel)])
+	l.lgr.Printf(format, v...)
+}
+
+func Warnln(v ...interface{}) {
+	l.lgr.SetOutput(l.files[l.getLevelDate(WarnLevel)])
+	log := l.ProcessLogFormat(WarnLevel, v...)
+	l.lgr.Println(log)
+}
+
 func Error(v ...interface{}) {
 	l.lgr.SetOutput(l.files[l.getLevelDate(ErrorLevel)])
 	log := l.ProcessLogFormat(ErrorLevel, v...)